@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"enroll-alert/enrollalert"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  history     show notifications sent to a user")
+	fmt.Fprintln(os.Stderr, "  unsuppress  resume emailing a user whose address bounced or complained")
+	fmt.Fprintln(os.Stderr, "  templates   check and preview email templates, and sync them to SES")
+	fmt.Fprintln(os.Stderr, "  alert       save seat alerts for a user")
+	fmt.Fprintln(os.Stderr, "  rule        check an alert expression, or save it as an alert for a user")
+	fmt.Fprintln(os.Stderr, "  course      save a new section or package alert for a whole course")
+	fmt.Fprintln(os.Stderr, "  search      save a search alert for a user")
+	fmt.Fprintln(os.Stderr, "  group       group a user's alerts so only the first to fire is sent")
+	fmt.Fprintln(os.Stderr, "  prefs       set a user's notification channels and quiet hours")
+	fmt.Fprintln(os.Stderr, "  mode        switch a user between instant and digest emails")
+	fmt.Fprintln(os.Stderr, "  webhook     save a webhook for a user and print its signing secret")
+	fmt.Fprintln(os.Stderr, "  chat        attach a Discord or Slack webhook to a user's alerts")
+	fmt.Fprintln(os.Stderr, "  push        save or remove a browser push subscription for a user")
+	fmt.Fprintln(os.Stderr, "  term        set the last add date alerts for a term expire after")
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	// templates don't need the DB, and rules only connect when saving
+	switch os.Args[1] {
+	case "templates":
+		if err := templatesCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "rule":
+		if err := ruleCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// perform Postgres DB connection
+	pool, err := pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	defer pool.Close()
+
+	switch os.Args[1] {
+	case "history":
+		err = historyCommand(pool, os.Args[2:])
+	case "unsuppress":
+		err = unsuppressCommand(pool, os.Args[2:])
+	case "alert":
+		err = alertCommand(pool, os.Args[2:])
+	case "course":
+		err = courseCommand(pool, os.Args[2:])
+	case "search":
+		err = searchCommand(pool, os.Args[2:])
+	case "group":
+		err = groupCommand(pool, os.Args[2:])
+	case "prefs":
+		err = prefsCommand(pool, os.Args[2:])
+	case "mode":
+		err = modeCommand(pool, os.Args[2:])
+	case "webhook":
+		err = webhookCommand(pool, os.Args[2:])
+	case "chat":
+		err = chatCommand(pool, os.Args[2:])
+	case "push":
+		err = pushCommand(pool, os.Args[2:])
+	case "term":
+		err = termCommand(pool, os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// historyCommand Prints a user's most recent notification delivery attempts.
+// Returns error if user can't be found or history can't be queried
+func historyCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	userFlag  := flags.String("user", "", "user ID, email or Firebase UID")
+	limitFlag := flags.Int("limit", 50, "number of notifications to show")
+	flags.Parse(args)
+
+	if *userFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	records, err := enrollalert.GetUserNotificationHistory(ctx, pool, userID, *limitFlag)
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		fmt.Printf("No notifications for user %d\n", userID)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENT AT\tCHANNEL\tSTATUS\tCOURSE\tSECTION\tTYPE\tSEATS (MATCHED/SENT)\tATTEMPT\tMESSAGE ID\tERROR")
+	for _, record := range records {
+
+		sentSeats := "-"
+		if record.OpenSeats != nil {
+			sentSeats = fmt.Sprintf("%d", *record.OpenSeats)
+		}
+
+		channel := record.Channel
+		if record.BatchKind != "" {
+			channel += " (" + record.BatchKind + ")"
+		} else if record.Batched {
+			channel += " (batched)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d/%s\t%d\t%s\t%s\n",
+			record.CreatedAt.Local().Format("2006-01-02 15:04:05"), channel, record.Status,
+			record.CourseName, record.SectionNum, record.AlertType, record.MatchedOpenSeats, sentSeats,
+			record.Attempt, record.ProviderMessageID, record.Error)
+	}
+
+	return w.Flush()
+}
+
+// unsuppressCommand Clears a user's bounced or complained email status.
+// Returns error if user can't be found or updated
+func unsuppressCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("unsuppress", flag.ExitOnError)
+	userFlag := flags.String("user", "", "user ID, email or Firebase UID")
+	flags.Parse(args)
+
+	if *userFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	if err := enrollalert.ClearEmailSuppression(ctx, pool, userID); err != nil {
+		return err
+	}
+
+	fmt.Printf("Cleared email suppression for user %d\n", userID)
+	return nil
+}
+
+// alertCommand Saves an alert of the given type for a user on each given section of a course.
+// Returns error if user can't be found or any alert isn't allowed, in which case none are saved
+func alertCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("alert", flag.ExitOnError)
+	userFlag      := flags.String("user", "", "user ID, email or Firebase UID")
+	termFlag      := flags.Int("term", 1262, "term number of the sections")
+	courseFlag    := flags.String("course", "", "course ID")
+	sectionsFlag  := flags.String("sections", "", "comma separated section numbers")
+	typeFlag      := flags.String("type", "any", "alert type (any, threshold or waitlist)")
+	thresholdFlag := flags.Int("threshold", 0, "open seats needed for threshold alerts")
+	flags.Parse(args)
+
+	if *userFlag == "" || *courseFlag == "" || *sectionsFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var seatThreshold *int
+	if *typeFlag == "threshold" {
+		seatThreshold = thresholdFlag
+	}
+
+	var alerts []enrollalert.NewAlert
+	for _, sectionNum := range strings.Split(*sectionsFlag, ",") {
+		alerts = append(alerts, enrollalert.NewAlert{
+			CourseID:      *courseFlag,
+			SectionNum:    strings.TrimSpace(sectionNum),
+			AlertType:     *typeFlag,
+			SeatThreshold: seatThreshold,
+		})
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	alertIDs, err := enrollalert.CreateAlerts(ctx, pool, userID, *termFlag, alerts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved alerts %v for user %d\n", alertIDs, userID)
+	return nil
+}
+
+// ruleCommand Checks an alert expression and, if a user and section are given, saves it as an
+// expression alert for them.
+// Returns error if expression is invalid or alert can't be saved
+func ruleCommand(args []string) error {
+
+	flags := flag.NewFlagSet("rule", flag.ExitOnError)
+	exprFlag    := flags.String("expr", "", `CEL expression over section fields, e.g. 'open_seats >= 2 && section_type == "LAB"'`)
+	userFlag    := flags.String("user", "", "user ID, email or Firebase UID to save the alert for")
+	courseFlag  := flags.String("course", "", "course ID of the alert's section")
+	sectionFlag := flags.String("section", "", "section number of the alert's section")
+	termFlag    := flags.Int("term", 1262, "term number of the alert's section")
+	flags.Parse(args)
+
+	if *exprFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := enrollalert.ValidateAlertExpression(*exprFlag); err != nil {
+		return err
+	}
+
+	if *userFlag == "" {
+		fmt.Println("Expression is valid")
+		return nil
+	}
+	if *courseFlag == "" || *sectionFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		return fmt.Errorf("Failed to connect to DB: %w", err)
+	}
+	defer pool.Close()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	alertID, err := enrollalert.SaveExpressionAlert(ctx, pool, userID, *termFlag, *courseFlag, *sectionFlag, *exprFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved expression alert %d for user %d\n", alertID, userID)
+	return nil
+}
+
+// courseCommand Saves a course level alert for a user and prints its ID.
+// Returns error if user can't be found or alert isn't allowed
+func courseCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("course", flag.ExitOnError)
+	userFlag   := flags.String("user", "", "user ID, email or Firebase UID")
+	termFlag   := flags.Int("term", 1262, "term number to watch")
+	courseFlag := flags.String("course", "", "course ID")
+	kindFlag   := flags.String("kind", "new_section", "alert kind (new_section or any_package)")
+	typeFlag   := flags.String("type", "", "only sections of this type (e.g. LAB)")
+	flags.Parse(args)
+
+	if *userFlag == "" || *courseFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	alertID, err := enrollalert.CreateCourseAlert(ctx, pool, userID, *termFlag, *courseFlag, *kindFlag, *typeFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved %s alert %d for user %d on course %s\n", *kindFlag, alertID, userID, *courseFlag)
+	return nil
+}
+
+// searchCommand Saves a search alert for a user from the given filters.
+// Returns error if user can't be found or search is invalid
+func searchCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	userFlag     := flags.String("user", "", "user ID, email or Firebase UID")
+	termFlag     := flags.Int("term", 1262, "term number to search")
+	breadthsFlag := flags.String("breadths", "", "comma separated breadth codes, courses need any one of them")
+	subjectFlag  := flags.String("subject", "", "subject code (e.g. 266)")
+	catalogFlag  := flags.String("catalog", "", "catalog number range (e.g. 300-699)")
+	typeFlag     := flags.String("type", "", "section type (e.g. LEC)")
+	flags.Parse(args)
+
+	if *userFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var search enrollalert.SearchAlert
+	search.SectionType = *typeFlag
+	if *breadthsFlag != "" {
+		search.BreadthCodes = strings.Split(*breadthsFlag, ",")
+	}
+	if *subjectFlag != "" {
+		subjectID, err := strconv.Atoi(*subjectFlag)
+		if err != nil {
+			return fmt.Errorf("Invalid subject code %q", *subjectFlag)
+		}
+		search.SubjectID = &subjectID
+	}
+	if *catalogFlag != "" {
+		low, high, _ := strings.Cut(*catalogFlag, "-")
+		catalogMin, err := strconv.Atoi(low)
+		if err != nil {
+			return fmt.Errorf("Invalid catalog number range %q", *catalogFlag)
+		}
+		catalogMax := catalogMin
+		if high != "" {
+			if catalogMax, err = strconv.Atoi(high); err != nil {
+				return fmt.Errorf("Invalid catalog number range %q", *catalogFlag)
+			}
+		}
+		search.CatalogMin, search.CatalogMax = &catalogMin, &catalogMax
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	searchID, err := enrollalert.SaveSearchAlert(ctx, pool, userID, *termFlag, search)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved search alert %d for user %d\n", searchID, userID)
+	return nil
+}
+
+// groupCommand Groups a user's alerts so the others are cancelled (or paused) once one fires.
+// Returns error if user can't be found or alerts can't be grouped
+func groupCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("group", flag.ExitOnError)
+	userFlag   := flags.String("user", "", "user ID, email or Firebase UID")
+	alertsFlag := flags.String("alerts", "", "comma separated IDs of the user's alerts to group")
+	pauseFlag  := flags.Duration("pause", 0, "pause the other alerts for this long instead of cancelling them (e.g. 24h)")
+	flags.Parse(args)
+
+	if *userFlag == "" || *alertsFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	alertIDs, err := parseAlertIDs(*alertsFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	groupID, err := enrollalert.GroupAlerts(ctx, pool, userID, alertIDs, *pauseFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Grouped %d alerts for user %d in group %d\n", len(alertIDs), userID, groupID)
+	return nil
+}
+
+// parseAlertIDs Parses comma separated alert IDs.
+// Returns list of IDs or error if any isn't a number
+func parseAlertIDs(value string) ([]int64, error) {
+	var alertIDs []int64
+	for _, field := range strings.Split(value, ",") {
+		alertID, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid alert ID %q", field)
+		}
+		alertIDs = append(alertIDs, alertID)
+	}
+	return alertIDs, nil
+}
+
+// prefsCommand Saves a user's notification preferences, replacing any they had.
+// Returns error if user can't be found or a preference is invalid
+func prefsCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("prefs", flag.ExitOnError)
+	userFlag       := flags.String("user", "", "user ID, email or Firebase UID")
+	channelsFlag   := flags.String("channels", "email,webhook,chat,push", "comma separated channels alerts are sent through")
+	timeZoneFlag   := flags.String("tz", "America/Chicago", "time zone quiet hours are in")
+	quietFlag      := flags.String("quiet", "", "quiet hours in local time (e.g. 22:00-07:00)")
+	quietSeatsFlag := flags.Bool("quiet-seat-alerts", true, "hold back seat alerts during quiet hours too")
+	quietModeFlag  := flags.String("quiet-mode", "defer", "defer or quiet_channels")
+	flags.Parse(args)
+
+	if *userFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	prefs := enrollalert.NotificationPrefs{
+		EnabledChannels: strings.Split(*channelsFlag, ","),
+		TimeZone:        *timeZoneFlag,
+		QuietSeatAlerts: *quietSeatsFlag,
+		QuietMode:       *quietModeFlag,
+	}
+	if *quietFlag != "" {
+		var found bool
+		if prefs.QuietStart, prefs.QuietEnd, found = strings.Cut(*quietFlag, "-"); !found {
+			return fmt.Errorf("Invalid quiet hours %q", *quietFlag)
+		}
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	if err := enrollalert.SaveNotificationPrefs(ctx, pool, userID, prefs); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved notification preferences for user %d\n", userID)
+	return nil
+}
+
+// modeCommand Sets whether a user gets an email per alert or a digest per run.
+// Returns error if user can't be found or mode is unknown
+func modeCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("mode", flag.ExitOnError)
+	userFlag := flags.String("user", "", "user ID, email or Firebase UID")
+	modeFlag := flags.String("mode", "", "instant or digest")
+	flags.Parse(args)
+
+	if *userFlag == "" || *modeFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	if err := enrollalert.SetNotificationMode(ctx, pool, userID, *modeFlag); err != nil {
+		return err
+	}
+
+	fmt.Printf("Set user %d to %s emails\n", userID, *modeFlag)
+	return nil
+}
+
+// webhookCommand Saves a webhook for a user and prints the secret its payloads are signed with.
+// Returns error if user can't be found or URL is refused
+func webhookCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("webhook", flag.ExitOnError)
+	userFlag := flags.String("user", "", "user ID, email or Firebase UID")
+	urlFlag  := flags.String("url", "", "https URL alerts are POSTed to")
+	flags.Parse(args)
+
+	if *userFlag == "" || *urlFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	hookID, secret, err := enrollalert.SaveWebhook(ctx, pool, userID, *urlFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved webhook %d for user %d, signing secret: %s\n", hookID, userID, secret)
+	return nil
+}
+
+// chatCommand Attaches a Discord or Slack incoming webhook to some of a user's alerts.
+// Returns error if user can't be found, URL is invalid or alerts aren't the user's
+func chatCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("chat", flag.ExitOnError)
+	userFlag     := flags.String("user", "", "user ID, email or Firebase UID")
+	platformFlag := flags.String("platform", "", "discord or slack")
+	urlFlag      := flags.String("url", "", "incoming webhook URL")
+	labelFlag    := flags.String("label", "", "name to show for the webhook (e.g. study group)")
+	alertsFlag   := flags.String("alerts", "", "comma separated IDs of the user's alerts to attach it to")
+	flags.Parse(args)
+
+	if *userFlag == "" || *platformFlag == "" || *urlFlag == "" || *alertsFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	alertIDs, err := parseAlertIDs(*alertsFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	hookID, err := enrollalert.AttachChatWebhook(ctx, pool, userID, *platformFlag, *urlFlag, *labelFlag, alertIDs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Attached chat webhook %d to %d alerts for user %d\n", hookID, len(alertIDs), userID)
+	return nil
+}
+
+// pushCommand Saves a browser push subscription (PushSubscription.toJSON()) for a user, or removes
+// one by endpoint.
+// Returns error if user can't be found or subscription is invalid
+func pushCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	userFlag   := flags.String("user", "", "user ID, email or Firebase UID")
+	subFlag    := flags.String("subscription", "", "subscription JSON from PushSubscription.toJSON()")
+	removeFlag := flags.String("remove", "", "endpoint of subscription to remove")
+	flags.Parse(args)
+
+	if *userFlag == "" || (*subFlag == "") == (*removeFlag == "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	userID, err := enrollalert.FindUserID(ctx, pool, *userFlag)
+	if err != nil {
+		return err
+	}
+
+	if *removeFlag != "" {
+		removed, err := enrollalert.RemovePushSubscription(ctx, pool, userID, *removeFlag)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("User %d has no push subscription for %s", userID, *removeFlag)
+		}
+		fmt.Printf("Removed push subscription for user %d\n", userID)
+		return nil
+	}
+
+	var sub enrollalert.PushSubscriptionJSON
+	if err := json.Unmarshal([]byte(*subFlag), &sub); err != nil {
+		return fmt.Errorf("Invalid subscription JSON: %w", err)
+	}
+
+	subID, err := enrollalert.SavePushSubscription(ctx, pool, userID, sub, "")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved push subscription %d for user %d\n", subID, userID)
+	return nil
+}
+
+// termCommand Sets the last day to add classes for a term, which its alerts expire after.
+// Returns error if date is invalid or can't be saved
+func termCommand(pool *pgxpool.Pool, args []string) error {
+
+	flags := flag.NewFlagSet("term", flag.ExitOnError)
+	termFlag    := flags.Int("term", 0, "term number (e.g. 1262)")
+	lastAddFlag := flags.String("last-add", "", "last day to add classes (YYYY-MM-DD)")
+	flags.Parse(args)
+
+	if *termFlag == 0 || *lastAddFlag == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	lastAddDate, err := time.Parse("2006-01-02", *lastAddFlag)
+	if err != nil {
+		return fmt.Errorf("Invalid last add date %q", *lastAddFlag)
+	}
+
+	if err := enrollalert.SetTermLastAddDate(context.Background(), pool, *termFlag, lastAddDate); err != nil {
+		return err
+	}
+
+	fmt.Printf("Alerts for term %d now expire after %s\n", *termFlag, *lastAddFlag)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"enroll-alert/enrollalert"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// templatesCommand Checks every email template's placeholders against the data the Go code
+// supplies, renders each email variant with sample data to files for preview and, if asked,
+// creates or updates the SES stored templates named by the template env variables.
+// Returns error if templates have problems, can't be rendered or can't be synced
+func templatesCommand(args []string) error {
+
+	flags := flag.NewFlagSet("templates", flag.ExitOnError)
+	outFlag  := flags.String("out", "email-preview", "directory to write rendered previews to")
+	syncFlag := flags.Bool("sync", false, "create or update SES stored templates")
+	flags.Parse(args)
+
+	// check placeholders before anything is rendered or uploaded
+	var problemCount int
+	for _, kind := range enrollalert.EmailTemplateKinds() {
+		problems, err := enrollalert.CheckEmailTemplate(kind)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println("PROBLEM", problem)
+		}
+		problemCount += len(problems)
+	}
+	if problemCount > 0 {
+		return fmt.Errorf("Found %d template problems", problemCount)
+	}
+	fmt.Println("All template placeholders are supplied")
+
+	// render previews
+	if err := os.MkdirAll(*outFlag, 0755); err != nil {
+		return fmt.Errorf("Error creating preview directory: %w", err)
+	}
+	for _, sample := range enrollalert.EmailSamples() {
+		email, err := enrollalert.RenderEmailSample(sample)
+		if err != nil {
+			return err
+		}
+
+		htmlPath := filepath.Join(*outFlag, sample.Name+".html")
+		textPath := filepath.Join(*outFlag, sample.Name+".txt")
+		if err := os.WriteFile(htmlPath, []byte(email.Html), 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %w", htmlPath, err)
+		}
+		if err := os.WriteFile(textPath, []byte("Subject: "+email.Subject+"\n\n"+email.Text), 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %w", textPath, err)
+		}
+		fmt.Printf("Rendered %s (%q) to %s\n", sample.Name, email.Subject, htmlPath)
+	}
+
+	if !*syncFlag {
+		return nil
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	svc := sesv2.NewFromConfig(cfg)
+
+	// same env variables the scraper uses to pick stored templates
+	names := map[string]string{
+		"seat-alert":    os.Getenv("ALERT_TEMPLATE"),
+		"new-section":   os.Getenv("NEW_SECTION_TEMPLATE"),
+		"alert-digest":  os.Getenv("DIGEST_TEMPLATE"),
+		"alert-expired": os.Getenv("EXPIRED_TEMPLATE"),
+		"search-results": os.Getenv("SEARCH_TEMPLATE"),
+	}
+	for _, kind := range enrollalert.EmailTemplateKinds() {
+		if names[kind] == "" {
+			fmt.Printf("Skipping %s, no SES template name set\n", kind)
+			continue
+		}
+
+		action, err := enrollalert.SyncSESTemplate(ctx, svc, names[kind], kind)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("SES template %s (%s): %s\n", names[kind], kind, action)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"enroll-alert/enrollalert"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+
+	addrFlag := flag.String("addr", ":8082", "address to listen on")
+	pathFlag := flag.String("path", "/alerts", "path the website posts alerts to")
+	termFlag := flag.Int("term", 1262, "term alerts are saved in until the terms table has one")
+	flag.Parse()
+
+	// perform Postgres DB connection
+	pool, err := pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	defer pool.Close()
+
+	// the website sends the same secret as a bearer token with each request
+	handler, err := enrollalert.NewAlertHandler(pool, os.Getenv("ALERTS_API_SECRET"), *termFlag)
+	if err != nil {
+		log.Fatalf("Error with alert handler setup: %v", err)
+	}
+
+	http.Handle(*pathFlag, handler)
+
+	log.Printf("Listening for alerts on %s%s", *addrFlag, *pathFlag)
+	log.Fatal(http.ListenAndServe(*addrFlag, nil))
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 	"enroll-alert/enrollalert"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -17,6 +19,10 @@ var (
 	countFlag     = flag.Int("count", 5666, "")
 	termFlag      = flag.Int("term", 1262, "")
 	batchSizeFlag = flag.Int("batchsize", 100, "")
+	dryRunFlag    = flag.Bool("dry-run", false, "")
+	recheckFlag   = flag.Bool("recheck", false, "")
+	debounceScrapesFlag = flag.Int("debounce-scrapes", 0, "")
+	debounceForFlag     = flag.Duration("debounce-for", 0, "")
 	parseOnce     sync.Once
 )
 
@@ -25,6 +31,10 @@ type Config struct {
 	count     int
 	term      int
 	batchSize int
+	dryRun    bool
+	recheck   bool
+	debounceScrapes int
+	debounceFor     time.Duration
 	postgresURL     string
 }
 
@@ -48,6 +58,16 @@ func envInt(search string, defaultFlag int) int {
 	return defaultFlag
 }
 
+// envDuration Parse duration flag (e.g. "10m") for given input.
+// Return input duration or default if no given input
+func envDuration(search string, defaultFlag time.Duration) time.Duration {
+	if flag, ok := os.LookupEnv(search); ok {
+		durationFlag, _ := time.ParseDuration(flag)
+		return durationFlag
+	}
+	return defaultFlag
+}
+
 // loadConfig Parse input flags and load DB URL.
 // Return config object containing flags and DB URL.
 func loadConfig() Config {
@@ -57,6 +77,10 @@ func loadConfig() Config {
 		count:     envInt("COUNT", *countFlag),
 		term:      envInt("TERM", *termFlag),
 		batchSize: envInt("BATCHSIZE", *batchSizeFlag),
+		dryRun:    envBool("DRY_RUN", *dryRunFlag),
+		recheck:   envBool("RECHECK_SEATS", *recheckFlag),
+		debounceScrapes: envInt("DEBOUNCE_SCRAPES", *debounceScrapesFlag),
+		debounceFor:     envDuration("DEBOUNCE_FOR", *debounceForFlag),
 		postgresURL:     os.Getenv("POSTGRES_URL"),
 	}
 }
@@ -68,6 +92,9 @@ func loadConfig() Config {
 func run(ctx context.Context, config Config) error {
 	enrollalert.TermNum = config.term
 	enrollalert.Term = strconv.Itoa(config.term)
+	enrollalert.RecheckSeats = config.recheck
+	enrollalert.DebounceObservations = config.debounceScrapes
+	enrollalert.DebounceDuration = config.debounceFor
 
 	// run initial DB loading if specified
 	if config.init {
@@ -87,19 +114,73 @@ func run(ctx context.Context, config Config) error {
 		return err
 	}
 
-	// scrape API for course section info and update DB
-	if err := enrollalert.CourseInfoUpdateDriver(pool, ids, config.batchSize); err != nil {
-		return err
+	// log what the scrape would change and which alerts would fire without saving or sending
+	if config.dryRun {
+		report, err := enrollalert.DryRunDriver(ctx, pool, ids, config.batchSize)
+		if err != nil {
+			return err
+		}
+		report.Print(os.Stdout)
+		return nil
 	}
 
-	// create SES email client
-	mail, err := enrollalert.NewEmailClient(ctx, os.Getenv("EMAIL_FROM"), os.Getenv("ALERT_TEMPLATE"))
+	// scrape API for course section info and update DB
+	diff, err := enrollalert.CourseInfoUpdateDriver(pool, ids, config.batchSize)
 	if err != nil {
 		return err
 	}
 
-	// send alert emails to users
-	return enrollalert.NotifyMatchingAlerts(ctx, pool, mail, enrollalert.TermNum)
+	// create unsubscribe link signer if configured
+	var unsubscribe *enrollalert.UnsubscribeLinks
+	if secret := os.Getenv("UNSUBSCRIBE_SECRET"); secret != "" {
+		unsubscribe, err = enrollalert.NewUnsubscribeLinks(secret, os.Getenv("UNSUBSCRIBE_URL"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// create email client, sending through SMTP instead of SES if configured
+	var mail *enrollalert.EmailClient
+	if os.Getenv("EMAIL_BACKEND") == "smtp" {
+		mail = enrollalert.NewSMTPEmailClient(os.Getenv("EMAIL_FROM"), os.Getenv("SMTP_ADDR"),
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), unsubscribe)
+	} else {
+		mail, err = enrollalert.NewEmailClient(ctx, os.Getenv("EMAIL_FROM"), enrollalert.EmailTemplates{
+			SeatAlert:  os.Getenv("ALERT_TEMPLATE"),
+			NewSection: os.Getenv("NEW_SECTION_TEMPLATE"),
+			Digest:     os.Getenv("DIGEST_TEMPLATE"),
+			Expired:    os.Getenv("EXPIRED_TEMPLATE"),
+			Search:     os.Getenv("SEARCH_TEMPLATE"),
+		}, unsubscribe)
+		if err != nil {
+			return err
+		}
+	}
+
+	// queue alerts for courses that had sections added, seat alerts are still sent if this fails
+	queueErr := enrollalert.QueueNewSectionAlerts(ctx, pool, enrollalert.TermNum, diff.NewSections)
+	if queueErr != nil {
+		log.Printf("Error with queueing new section alerts: %v", queueErr)
+	}
+
+	notifiers := []enrollalert.Notifier{
+		enrollalert.NewWebhookNotifier(pool),
+		enrollalert.NewChatNotifier(pool),
+	}
+
+	// create Web Push notifier if VAPID keys are configured
+	if vapidKey := os.Getenv("VAPID_PRIVATE_KEY"); vapidKey != "" {
+		push, err := enrollalert.NewPushNotifier(pool, os.Getenv("VAPID_PUBLIC_KEY"), vapidKey, os.Getenv("VAPID_SUBJECT"))
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, push)
+	}
+
+	// send alert emails, webhooks, chat messages and pushes to users
+	notifyErr := enrollalert.NotifyMatchingAlerts(ctx, pool, mail, enrollalert.TermNum, diff.StartedAt, notifiers...)
+
+	return errors.Join(queueErr, notifyErr)
 }
 
 // handler Handler for scraping driver.
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -22,15 +23,28 @@ func main() {
 
 	// check for batch size (100 as deafult)
 	batchSize   := flag.Int("batchsize", 100, "batch size of API calls")
+
+	// check for dry run (scrape and match alerts without writing to DB or sending anything)
+	dryRunFlag  := flag.Bool("dry-run", false, "scrape and match alerts, printing a report instead of saving or sending")
+
+	// check for re-checking seat info right before alerts are sent
+	recheckFlag := flag.Bool("recheck", false, "re-fetch each alert's section before sending and skip alerts that no longer match")
+
+	// check for how long sections must keep matching before alerts fire (fire on first match as default)
+	debounceScrapes := flag.Int("debounce-scrapes", 0, "scrapes in a row a section must match before its alerts fire")
+	debounceFor     := flag.Duration("debounce-for", 0, "how long a section must match before its alerts fire")
 	
 	flag.Parse()
 
 	// set term number
 	enrollalert.TermNum = *termFlag
   enrollalert.Term    = fmt.Sprintf("%d", enrollalert.TermNum)
+	enrollalert.RecheckSeats = *recheckFlag
+	enrollalert.DebounceObservations = *debounceScrapes
+	enrollalert.DebounceDuration     = *debounceFor
 
-	log.Printf("Startup: init=%t, count=%d, term=%d",
-		*initialFlag, *countFlag, *termFlag)
+	log.Printf("Startup: init=%t, count=%d, term=%d, dry-run=%t",
+		*initialFlag, *countFlag, *termFlag, *dryRunFlag)
 
 	timeStart := time.Now()
 
@@ -58,22 +72,81 @@ func main() {
 	}
 
 	log.Printf("Course ID retrieval successful.")
+
+	// print what the scrape would change and which alerts would fire without saving or sending
+	if *dryRunFlag {
+		report, err := enrollalert.DryRunDriver(context.Background(), pool, courseIDs, *batchSize)
+		if err != nil {
+			log.Fatalf("Error with dry run: %v", err)
+		}
+		report.Print(os.Stdout)
+
+		log.Printf("Dry run done in %s", time.Since(timeStart))
+		return
+	}
 	
 	// conduct course section info update
-	err = enrollalert.CourseInfoUpdateDriver(pool, courseIDs, *batchSize)
+	diff, err := enrollalert.CourseInfoUpdateDriver(pool, courseIDs, *batchSize)
 	if err != nil {
 		log.Fatalf("Error with course section info update: %v", err)
 	} 
 
-	// create email clients 
-	mail, err := enrollalert.NewEmailClient(context.Background(), os.Getenv("EMAIL_FROM"))
-	if err != nil {
-		log.Fatalf("Error with email client creation: %v", err)
+	// create unsubscribe link signer if configured
+	var unsubscribe *enrollalert.UnsubscribeLinks
+	if secret := os.Getenv("UNSUBSCRIBE_SECRET"); secret != "" {
+		unsubscribe, err = enrollalert.NewUnsubscribeLinks(secret, os.Getenv("UNSUBSCRIBE_URL"))
+		if err != nil {
+			log.Fatalf("Error with unsubscribe link setup: %v", err)
+		}
+	}
+
+	// create email client, sending through SMTP (e.g. MailHog) instead of SES if configured
+	var mail *enrollalert.EmailClient
+	if os.Getenv("EMAIL_BACKEND") == "smtp" {
+		mail = enrollalert.NewSMTPEmailClient(os.Getenv("EMAIL_FROM"), os.Getenv("SMTP_ADDR"),
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), unsubscribe)
+	} else {
+		mail, err = enrollalert.NewEmailClient(context.Background(), os.Getenv("EMAIL_FROM"), enrollalert.EmailTemplates{
+			SeatAlert:  os.Getenv("ALERT_TEMPLATE"),
+			NewSection: os.Getenv("NEW_SECTION_TEMPLATE"),
+			Digest:     os.Getenv("DIGEST_TEMPLATE"),
+			Expired:    os.Getenv("EXPIRED_TEMPLATE"),
+			Search:     os.Getenv("SEARCH_TEMPLATE"),
+		}, unsubscribe)
+		if err != nil {
+			log.Fatalf("Error with email client creation: %v", err)
+		}
+	}
+
+	// queue alerts for courses that had sections added, seat alerts are still sent if this fails
+	queueErr := enrollalert.QueueNewSectionAlerts(context.Background(), pool, enrollalert.TermNum, diff.NewSections)
+	if queueErr != nil {
+		log.Printf("Error with queueing new section alerts: %v", queueErr)
 	}
 
 	// send alert emails for sections that now match alerts
-	if err := enrollalert.NotifyMatchingAlerts(context.Background(), pool, mail, enrollalert.TermNum); err != nil {
-		log.Printf("Error with alert email sending: %v", err)
+	notifiers := []enrollalert.Notifier{
+		enrollalert.NewWebhookNotifier(pool),
+		enrollalert.NewChatNotifier(pool),
+	}
+
+	// create Web Push notifier if VAPID keys are configured
+	if vapidKey := os.Getenv("VAPID_PRIVATE_KEY"); vapidKey != "" {
+		push, err := enrollalert.NewPushNotifier(pool, os.Getenv("VAPID_PUBLIC_KEY"), vapidKey, os.Getenv("VAPID_SUBJECT"))
+		if err != nil {
+			log.Fatalf("Error with push notifier creation: %v", err)
+		}
+		notifiers = append(notifiers, push)
+	}
+
+	notifyErr := enrollalert.NotifyMatchingAlerts(context.Background(), pool, mail, enrollalert.TermNum, diff.StartedAt, notifiers...)
+	if notifyErr != nil {
+		log.Printf("Error with alert email sending: %v", notifyErr)
+	}
+
+	// fail the run like the Lambda does once every alert that could be sent has been
+	if queueErr != nil || notifyErr != nil {
+		log.Fatalf("Alerts weren't all queued and sent: %v", errors.Join(queueErr, notifyErr))
 	}
 
 	log.Printf("Course section info update successful.")
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"enroll-alert/enrollalert"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+
+	addrFlag  := flag.String("addr", ":8080", "address to listen on")
+	pathFlag  := flag.String("path", "/ses-events", "path SNS posts events to")
+	localFlag := flag.Bool("local", false, "trust signing certificates served from localhost (for snsstub)")
+	flag.Parse()
+
+	// perform Postgres DB connection
+	pool, err := pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	defer pool.Close()
+
+	verifier := enrollalert.NewSNSVerifier()
+	if *localFlag {
+		log.Printf("Trusting local SNS signing certificates")
+		verifier = enrollalert.NewLocalSNSVerifier()
+	}
+
+	// only accept messages from configured topics (comma separated) if any are set
+	var topics []string
+	if arns := os.Getenv("SES_EVENTS_TOPIC_ARNS"); arns != "" {
+		topics = strings.Split(arns, ",")
+	}
+
+	http.Handle(*pathFlag, enrollalert.NewSESEventHandler(pool, verifier, topics...))
+
+	log.Printf("Listening for SES events on %s%s", *addrFlag, *pathFlag)
+	log.Fatal(http.ListenAndServe(*addrFlag, nil))
+}
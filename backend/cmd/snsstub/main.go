@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+// local stand-in for SNS that signs sample SES event payloads with a throwaway certificate and
+// posts them to the SES event endpoint (run it with -local so it trusts the certificate)
+
+const topicARN = "arn:aws:sns:us-east-1:000000000000:enroll-alert-ses-events"
+
+func main() {
+
+	endpointFlag  := flag.String("endpoint", "http://localhost:8080/ses-events", "SES event endpoint to post to")
+	eventFlag     := flag.String("event", "bounce", "message to send: subscribe, bounce, soft-bounce or complaint")
+	emailFlag     := flag.String("email", "bounce@simulator.amazonses.com", "recipient the event is for")
+	messageIDFlag := flag.String("message-id", "", "SES message ID the event is for")
+	flag.Parse()
+
+	key, certPEM, err := newSigningCert()
+	if err != nil {
+		log.Fatalf("Error creating signing certificate: %v", err)
+	}
+
+	// serve signing certificate and subscription confirmation URL locally
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	confirmed := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cert.pem", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(certPEM)
+	})
+	mux.HandleFunc("/confirm", func(w http.ResponseWriter, r *http.Request) {
+		confirmed <- struct{}{}
+		w.Write([]byte("<ConfirmSubscriptionResponse/>"))
+	})
+	go http.Serve(listener, mux)
+
+	message, err := sampleMessage(*eventFlag, *emailFlag, *messageIDFlag, baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sign(message, key, baseURL+"/cert.pem"); err != nil {
+		log.Fatalf("Error signing message: %v", err)
+	}
+
+	body, _ := json.Marshal(message)
+	request, _ := http.NewRequest("POST", *endpointFlag, bytes.NewReader(body))
+	request.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	request.Header.Set("x-amz-sns-message-type", message["Type"])
+	request.Header.Set("x-amz-sns-topic-arn", topicARN)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatalf("Error posting message: %v", err)
+	}
+	defer response.Body.Close()
+	responseBody, _ := io.ReadAll(response.Body)
+
+	fmt.Printf("%s message posted, endpoint responded %d %s\n", *eventFlag, response.StatusCode, bytes.TrimSpace(responseBody))
+
+	if *eventFlag == "subscribe" {
+		select {
+		case <-confirmed:
+			fmt.Println("subscription confirmed")
+		default:
+			fmt.Println("subscription was not confirmed")
+		}
+	}
+}
+
+// newSigningCert Creates throwaway RSA key and self signed certificate to sign messages with.
+// Returns key, PEM encoded certificate or error if generation fails
+func newSigningCert() (*rsa.PrivateKey, []byte, error) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// sampleMessage Builds SNS message of given kind wrapping a sample SES event.
+// Returns message fields or error if kind isn't known
+func sampleMessage(kind string, email string, messageID string, baseURL string) (map[string]string, error) {
+
+	message := map[string]string{
+		"MessageId": fmt.Sprintf("stub-%d", time.Now().UnixNano()),
+		"TopicArn":  topicARN,
+		"Timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if messageID == "" {
+		messageID = fmt.Sprintf("stub-ses-%d", time.Now().UnixNano())
+	}
+	mail := map[string]interface{}{
+		"messageId":   messageID,
+		"destination": []string{email},
+	}
+
+	var event map[string]interface{}
+	switch kind {
+	case "subscribe":
+		message["Type"] = "SubscriptionConfirmation"
+		message["Token"] = "stub-token"
+		message["Message"] = "You have chosen to subscribe to the topic " + topicARN
+		message["SubscribeURL"] = baseURL + "/confirm"
+		return message, nil
+
+	case "bounce", "soft-bounce":
+		bounceType, subType := "Permanent", "General"
+		if kind == "soft-bounce" {
+			bounceType, subType = "Transient", "MailboxFull"
+		}
+		event = map[string]interface{}{
+			"notificationType": "Bounce",
+			"mail":             mail,
+			"bounce": map[string]interface{}{
+				"bounceType":    bounceType,
+				"bounceSubType": subType,
+				"bouncedRecipients": []map[string]string{
+					{"emailAddress": email, "diagnosticCode": "smtp; 550 5.1.1 user unknown"},
+				},
+			},
+		}
+
+	case "complaint":
+		event = map[string]interface{}{
+			"notificationType": "Complaint",
+			"mail":             mail,
+			"complaint": map[string]interface{}{
+				"complaintFeedbackType": "abuse",
+				"complainedRecipients":  []map[string]string{{"emailAddress": email}},
+			},
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown event %q", kind)
+	}
+
+	payload, _ := json.Marshal(event)
+	message["Type"] = "Notification"
+	message["Message"] = string(payload)
+
+	return message, nil
+}
+
+// sign Signs message the way SNS does with signature version 2 (SHA256withRSA).
+// Returns error if signing fails
+func sign(message map[string]string, key *rsa.PrivateKey, certURL string) error {
+
+	keys := []string{"Message", "MessageId", "Subject", "Timestamp", "TopicArn", "Type"}
+	if message["Type"] != "Notification" {
+		keys = []string{"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"}
+	}
+
+	var toSign bytes.Buffer
+	for _, k := range keys {
+		if value, ok := message[k]; ok {
+			toSign.WriteString(k + "\n" + value + "\n")
+		}
+	}
+
+	digest := sha256.Sum256(toSign.Bytes())
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+
+	message["SignatureVersion"] = "2"
+	message["Signature"] = base64.StdEncoding.EncodeToString(signature)
+	message["SigningCertURL"] = certURL
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"enroll-alert/enrollalert"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+
+	addrFlag := flag.String("addr", ":8081", "address to listen on")
+	pathFlag := flag.String("path", "/unsubscribe", "path unsubscribe links point to")
+	flag.Parse()
+
+	// perform Postgres DB connection
+	pool, err := pgxpool.New(context.Background(), os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	defer pool.Close()
+
+	// links are signed by the scraper with the same secret
+	links, err := enrollalert.NewUnsubscribeLinks(os.Getenv("UNSUBSCRIBE_SECRET"), os.Getenv("UNSUBSCRIBE_URL"))
+	if err != nil {
+		log.Fatalf("Error with unsubscribe link setup: %v", err)
+	}
+
+	http.Handle(*pathFlag, enrollalert.NewUnsubscribeHandler(pool, links))
+
+	log.Printf("Listening for unsubscribes on %s%s", *addrFlag, *pathFlag)
+	log.Fatal(http.ListenAndServe(*addrFlag, nil))
+}
@@ -0,0 +1,9 @@
+// Package emailtemplates embeds the alert email templates so they ship with the binary.
+// The .html and .txt files are the email bodies and each *-template.json is the SES stored
+// template (subject and bodies) uploaded to SES.
+package emailtemplates
+
+import "embed"
+
+//go:embed *.html *.txt *.json
+var Files embed.FS
@@ -0,0 +1,106 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ExpireAlerts Archives alerts past their expiry date, or past the end of given term's last add
+// date if they don't have one, and queues a notice for users whose alert expired without ever
+// going off. Sections last scraped in another term aren't used, so their alerts also fall back
+// to given term.
+// Returns number of alerts expired and notices queued, or error if cleanup fails
+func ExpireAlerts(ctx context.Context, pool DB, term int) (int64, int64, error) {
+
+	var expired, notified int64
+	err := pool.QueryRow(ctx, `
+		WITH due AS (
+			SELECT uc.id,
+			       COALESCE(uc.expires_at, (t.last_add_date + 1)::timestamp AT TIME ZONE 'America/Chicago') AS expires_at,
+			       cs.course_name,
+			       cs.term
+			FROM user_courses uc
+			LEFT JOIN course_sections cs
+			     ON cs.course_id   = uc.course_id
+			    AND cs.section_num = uc.section_num
+			    AND cs.term        = $1
+			LEFT JOIN terms t ON t.term = COALESCE(cs.term, $1)
+			WHERE COALESCE(uc.expires_at, (t.last_add_date + 1)::timestamp AT TIME ZONE 'America/Chicago')
+			      <= CURRENT_TIMESTAMP
+			FOR UPDATE OF uc
+		),
+		expired AS (
+			DELETE FROM user_courses uc
+			USING due
+			WHERE uc.id = due.id
+			RETURNING uc.id, uc.user_id, uc.course_id, uc.section_num, uc.alert_type, uc.seat_threshold,
+			          uc.expression, uc.persistent, uc.fire_count, due.expires_at, due.course_name, due.term
+		),
+		archived AS (
+			INSERT INTO user_courses_archive (
+				id, user_id, course_id, section_num, alert_type, seat_threshold, expression,
+				persistent, fire_count, expires_at, reason
+			)
+			SELECT id, user_id, course_id, section_num, alert_type, seat_threshold, expression,
+			       persistent, fire_count, expires_at, 'expired'
+			FROM expired
+			ON CONFLICT (id) DO NOTHING
+			RETURNING id
+		),
+		notified AS (
+			INSERT INTO notification_outbox (
+				idempotency_key, user_id, email, term, course_id, course_name, section_num,
+				alert_type, seat_threshold, open_seats
+			)
+			SELECT gen_random_uuid()::text, e.user_id, u.email, COALESCE(e.term, $1), e.course_id,
+			       COALESCE(e.course_name, e.course_id), e.section_num, 'expired', e.seat_threshold, 0
+			FROM expired e
+			JOIN users u ON u.id = e.user_id
+			WHERE e.fire_count = 0
+			  AND COALESCE(u.email, '') <> ''
+			RETURNING id
+		)
+		SELECT (SELECT count(*) FROM expired), (SELECT count(*) FROM notified);
+	`, term).Scan(&expired, &notified)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error with expiring alerts: %w", err)
+	}
+
+	return expired, notified, nil
+}
+
+// GetCurrentTerm Returns the current term (the newest term in terms, as the DB checks new alerts
+// against), fallback if terms is empty, or error if it can't be read
+func GetCurrentTerm(ctx context.Context, pool DB, fallback int) (int, error) {
+
+	var term *int
+	if err := pool.QueryRow(ctx, `
+		SELECT max(term) FROM terms;
+	`).Scan(&term); err != nil {
+		return 0, fmt.Errorf("Error getting current term: %w", err)
+	}
+
+	if term == nil {
+		return fallback, nil
+	}
+
+	return *term, nil
+}
+
+// SetTermLastAddDate Saves the last day students can add classes in given term, which alerts
+// for the term expire after by default.
+// Returns error if date can't be saved
+func SetTermLastAddDate(ctx context.Context, pool DB, term int, lastAddDate time.Time) error {
+
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO terms (term, last_add_date)
+		VALUES ($1, $2)
+		ON CONFLICT (term)
+		DO UPDATE SET last_add_date = EXCLUDED.last_add_date;
+	`, term, lastAddDate); err != nil {
+		return fmt.Errorf("Error saving last add date for term %d: %w", term, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"github.com/google/cel-go/cel"
+)
+
+const (
+	maxExpressionLength = 500
+
+	// evaluation cost limit so an expression can't slow down matching for everyone
+	maxExpressionCost = 1000
+
+	// most compiled programs kept between runs, the cache starts over once it's full
+	maxCachedExpressions = 1000
+)
+
+var (
+	expressionEnv     *cel.Env
+	expressionEnvErr  error
+	expressionEnvOnce sync.Once
+
+	// compiled programs of saved alerts keyed by expression, shared between runs. Expressions only
+	// being validated aren't cached so users can't grow it
+	expressionPrograms      = make(map[string]cel.Program)
+	expressionProgramsMutex sync.Mutex
+)
+
+// section fields an alert expression can use
+type sectionFields struct {
+	CourseID          string
+	CourseName        string
+	SectionNum        string
+	SectionType       string
+	SubjectID         int
+	ProfName          string
+	Capacity          int
+	Enrolled          int
+	OpenSeats         int
+	WaitlistCapacity  int
+	WaitlistOpenSpots int
+}
+
+// vars Returns fields as CEL variables
+func (fields *sectionFields) vars() map[string]any {
+	return map[string]any{
+		"course_id":           fields.CourseID,
+		"course_name":         fields.CourseName,
+		"section_num":         fields.SectionNum,
+		"section_type":        fields.SectionType,
+		"subject_id":          fields.SubjectID,
+		"prof_name":           fields.ProfName,
+		"capacity":            fields.Capacity,
+		"enrolled":            fields.Enrolled,
+		"open_seats":          fields.OpenSeats,
+		"waitlist_capacity":   fields.WaitlistCapacity,
+		"waitlist_open_spots": fields.WaitlistOpenSpots,
+	}
+}
+
+// getExpressionEnv Returns CEL environment declaring every section field alert expressions can use
+func getExpressionEnv() (*cel.Env, error) {
+	expressionEnvOnce.Do(func() {
+		expressionEnv, expressionEnvErr = cel.NewEnv(
+			cel.Variable("course_id", cel.StringType),
+			cel.Variable("course_name", cel.StringType),
+			cel.Variable("section_num", cel.StringType),
+			cel.Variable("section_type", cel.StringType),
+			cel.Variable("subject_id", cel.IntType),
+			cel.Variable("prof_name", cel.StringType),
+			cel.Variable("capacity", cel.IntType),
+			cel.Variable("enrolled", cel.IntType),
+			cel.Variable("open_seats", cel.IntType),
+			cel.Variable("waitlist_capacity", cel.IntType),
+			cel.Variable("waitlist_open_spots", cel.IntType),
+		)
+	})
+	return expressionEnv, expressionEnvErr
+}
+
+// compileExpression Parses and type checks alert expression, which must be a CEL expression over
+// section fields that evaluates to a bool.
+// Returns program ready to evaluate or error describing why the expression is invalid
+func compileExpression(expression string) (cel.Program, error) {
+
+	if expression == "" {
+		return nil, errors.New("Expression is empty")
+	}
+	if len(expression) > maxExpressionLength {
+		return nil, fmt.Errorf("Expression is longer than %d characters", maxExpressionLength)
+	}
+
+	env, err := getExpressionEnv()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating expression environment: %w", err)
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("Invalid expression: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("Expression must be true or false, not %s", ast.OutputType())
+	}
+
+	program, err := env.Program(ast, cel.CostLimit(maxExpressionCost))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression: %w", err)
+	}
+
+	return program, nil
+}
+
+// cachedExpressionProgram Returns compiled program for a saved alert's expression, compiling and
+// caching it the first time, or error if expression is invalid
+func cachedExpressionProgram(expression string) (cel.Program, error) {
+
+	expressionProgramsMutex.Lock()
+	program, ok := expressionPrograms[expression]
+	expressionProgramsMutex.Unlock()
+	if ok {
+		return program, nil
+	}
+
+	program, err := compileExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	expressionProgramsMutex.Lock()
+	if len(expressionPrograms) >= maxCachedExpressions {
+		clear(expressionPrograms)
+	}
+	expressionPrograms[expression] = program
+	expressionProgramsMutex.Unlock()
+
+	return program, nil
+}
+
+// ValidateAlertExpression Checks that alert expression compiles and evaluates to a bool, e.g.
+// open_seats >= 2 && section_type == "LAB" or prof_name.contains("Smith").
+// Returns error describing why the expression is invalid
+func ValidateAlertExpression(expression string) error {
+	_, err := compileExpression(expression)
+	return err
+}
+
+// evalExpression Evaluates alert expression against section's fields.
+// Returns whether section matches or error if expression is invalid or fails to evaluate
+func evalExpression(expression string, fields *sectionFields) (bool, error) {
+
+	program, err := cachedExpressionProgram(expression)
+	if err != nil {
+		return false, err
+	}
+
+	out, _, err := program.Eval(fields.vars())
+	if err != nil {
+		return false, fmt.Errorf("Error evaluating expression: %w", err)
+	}
+
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("Expression returned %v instead of true or false", out.Value())
+	}
+
+	return matched, nil
+}
+
+// SaveExpressionAlert Validates expression and saves it as an expression alert for the user on
+// given section in term.
+// Returns ID of new alert or error if expression is invalid or alert can't be saved
+func SaveExpressionAlert(ctx context.Context, pool DB, userID int, term int, courseID string, sectionNum string,
+	expression string) (int64, error) {
+
+	alertIDs, err := CreateAlerts(ctx, pool, userID, term, []NewAlert{{
+		CourseID:   courseID,
+		SectionNum: sectionNum,
+		AlertType:  "expression",
+		Expression: expression,
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	return alertIDs[0], nil
+}
@@ -0,0 +1,179 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5"
+)
+
+// longest a group's other alerts are held while the alert that fired waits to be sent, so they
+// come back on their own if the alert is never sent
+const groupHoldDuration = 48 * time.Hour
+
+// holdGroupAlternatives Pauses every other alert in the group of each alert that fired until the
+// fired alert is sent (see clearGroupAlternatives) or released (see releaseGroupAlternatives), or
+// for groupHoldDuration at most.
+// Returns error if alerts can't be updated
+func holdGroupAlternatives(ctx context.Context, tx pgx.Tx, winners map[int64]int64) error {
+
+	if len(winners) == 0 {
+		return nil
+	}
+
+	var groupIDs, alertIDs []int64
+	for groupID, alertID := range winners {
+		groupIDs = append(groupIDs, groupID)
+		alertIDs = append(alertIDs, alertID)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE user_courses uc
+		SET paused_until = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+		FROM unnest($1::bigint[], $2::bigint[]) AS w (group_id, alert_id)
+		WHERE uc.group_id = w.group_id
+		  AND uc.id      <> w.alert_id;
+	`, groupIDs, alertIDs, groupHoldDuration.Seconds()); err != nil {
+		return fmt.Errorf("Error with holding alert group alternatives: %w", err)
+	}
+
+	return nil
+}
+
+// clearGroupAlternatives Cancels or pauses (depending on the group) the other alerts in the group
+// of an alert whose outbox entry was just sent, and removes the group if it's left with no alerts.
+// alertID is the sent alert if it was kept, 0 otherwise.
+// Returns error if alerts can't be updated
+func clearGroupAlternatives(ctx context.Context, tx pgx.Tx, groupID int64, alertID int64) error {
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM user_courses uc
+		USING alert_groups g
+		WHERE g.id        = $1
+		  AND uc.group_id = g.id
+		  AND uc.id      <> $2
+		  AND g.on_fire   = 'cancel';
+	`, groupID, alertID); err != nil {
+		return fmt.Errorf("Error with cancelling alert group alternatives: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE user_courses uc
+		SET paused_until = CURRENT_TIMESTAMP + g.pause_minutes * INTERVAL '1 minute'
+		FROM alert_groups g
+		WHERE g.id        = $1
+		  AND uc.group_id = g.id
+		  AND uc.id      <> $2
+		  AND g.on_fire   = 'pause';
+	`, groupID, alertID); err != nil {
+		return fmt.Errorf("Error with pausing alert group alternatives: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM alert_groups g
+		WHERE g.id = $1
+		  AND NOT EXISTS (SELECT 1 FROM user_courses uc WHERE uc.group_id = g.id);
+	`, groupID); err != nil {
+		return fmt.Errorf("Error with removing empty alert group: %w", err)
+	}
+
+	return nil
+}
+
+// releaseGroupAlternatives Resumes the other alerts in the group of an alert whose outbox entry
+// won't be sent (it failed or was dropped), so the group can fire again.
+// alertID is the alert that fired if it was kept, 0 otherwise.
+// Returns error if alerts can't be updated
+func releaseGroupAlternatives(ctx context.Context, pool DB, groupID int64, alertID int64) error {
+
+	if _, err := pool.Exec(ctx, `
+		UPDATE user_courses
+		SET paused_until = NULL
+		WHERE group_id = $1
+		  AND id      <> $2
+		  AND paused_until > CURRENT_TIMESTAMP;
+	`, groupID, alertID); err != nil {
+		return fmt.Errorf("Error with releasing alert group %d alternatives: %w", groupID, err)
+	}
+
+	return nil
+}
+
+// GroupAlerts Puts the user's given alerts in a new group so only the first of them to fire is
+// sent. The others are cancelled when it fires, or paused for pause if it's more than 0.
+// Returns ID of new group or error if any alert isn't the user's or group can't be saved
+func GroupAlerts(ctx context.Context, pool DB, userID int, alertIDs []int64, pause time.Duration) (int64, error) {
+
+	if len(alertIDs) < 2 {
+		return 0, errors.New("Alert group needs at least two alerts")
+	}
+
+	onFire := "cancel"
+	var pauseMinutes *int
+	if pause > 0 {
+		minutes := max(int(pause.Minutes()), 1)
+		onFire, pauseMinutes = "pause", &minutes
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Error starting alert group transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var groupID int64
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO alert_groups (user_id, on_fire, pause_minutes)
+		VALUES ($1, $2, $3)
+		RETURNING id;
+	`, userID, onFire, pauseMinutes).Scan(&groupID); err != nil {
+		return 0, fmt.Errorf("Error saving alert group: %w", err)
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE user_courses
+		SET group_id = $1, paused_until = NULL
+		WHERE user_id = $2
+		  AND id = ANY($3);
+	`, groupID, userID, alertIDs)
+	if err != nil {
+		return 0, fmt.Errorf("Error adding alerts to group: %w", err)
+	}
+	if tag.RowsAffected() != int64(len(alertIDs)) {
+		return 0, fmt.Errorf("Only %d of %d alerts belong to user %d", tag.RowsAffected(), len(alertIDs), userID)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("Error committing alert group transaction: %w", err)
+	}
+
+	return groupID, nil
+}
+
+// alternativesAction Returns what was done to the alert's group alternatives when it fired,
+// e.g. "cancelled" or "paused for 2 hours"
+func (alert *SeatAlert) alternativesAction() string {
+
+	minutes := alert.AlternativesPausedMinutes
+	switch {
+	case minutes == 0:
+		return "cancelled"
+	case minutes%(24*60) == 0:
+		return fmt.Sprintf("paused for %d day(s)", minutes/(24*60))
+	case minutes%60 == 0:
+		return fmt.Sprintf("paused for %d hour(s)", minutes/60)
+	}
+	return fmt.Sprintf("paused for %d minute(s)", minutes)
+}
+
+// alternativesSummary Returns sentence listing the alert's cleared group alternatives, or an
+// empty string if it had none
+func (alert *SeatAlert) alternativesSummary() string {
+	if len(alert.ClearedAlternatives) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" Your other alerts in its group were %s: %s.",
+		alert.alternativesAction(), strings.Join(alert.ClearedAlternatives, ", "))
+}
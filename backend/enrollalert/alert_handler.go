@@ -0,0 +1,136 @@
+package enrollalert
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// largest alert request accepted, a user can't have more alerts than fit in this
+const alertRequestMaxBody = 64 * 1024
+
+// alert as sent by the website
+type alertRequestAlert struct {
+	CourseID      string `json:"courseId"`
+	SectionNum    string `json:"sectionNum"`
+	AlertType     string `json:"alertType"`
+	SeatThreshold *int   `json:"seatThreshold"`
+	Expression    string `json:"expression"`
+}
+
+// structure of requests to save alerts, the website has already authenticated the user
+type alertRequest struct {
+	UserID int                 `json:"userId"`
+	Alerts []alertRequestAlert `json:"alerts"`
+}
+
+// AlertHandler saves alerts for users of the website, which authenticates the user and forwards
+// their alerts with a shared secret
+type AlertHandler struct {
+	pool        *pgxpool.Pool
+	secret      []byte
+	defaultTerm int
+}
+
+// NewAlertHandler creates handler saving alerts in the current term for requests carrying secret
+// as a bearer token, defaultTerm is used until the terms table has a term
+func NewAlertHandler(pool *pgxpool.Pool, secret string, defaultTerm int) (*AlertHandler, error) {
+
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("Alert API secret must be at least 32 characters")
+	}
+
+	return &AlertHandler{pool: pool, secret: []byte(secret), defaultTerm: defaultTerm}, nil
+}
+
+// alertErrorStatus Returns HTTP status for an error from CreateAlerts and the alert error it
+// wraps, nil if its message can't be shown to the user
+func alertErrorStatus(err error) (int, error) {
+	switch {
+	case errors.Is(err, ErrInvalidAlert):
+		return http.StatusBadRequest, ErrInvalidAlert
+	case errors.Is(err, ErrSectionNotFound):
+		return http.StatusNotFound, ErrSectionNotFound
+	case errors.Is(err, ErrDuplicateAlert):
+		return http.StatusConflict, ErrDuplicateAlert
+	case errors.Is(err, ErrAlertQuota):
+		return http.StatusGone, ErrAlertQuota
+	}
+	return http.StatusInternalServerError, nil
+}
+
+// alertErrorMessage Returns the details of an alert error from CreateAlerts as a sentence for the
+// user (e.g. "You can only save up to 20 alerts (you have 20)"), without the error it wraps
+func alertErrorMessage(err error, kind error) string {
+	message := strings.TrimPrefix(err.Error(), kind.Error()+": ")
+	return strings.ToUpper(message[:1]) + message[1:]
+}
+
+// writeAlertResponse Writes JSON response with given status
+func writeAlertResponse(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// ServeHTTP Validates and saves the user's alerts with CreateAlerts, responding with the new
+// alert IDs or an error message that can be shown to the user
+func (h *AlertHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), h.secret) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request alertRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, alertRequestMaxBody))
+	if err := decoder.Decode(&request); err != nil || request.UserID <= 0 {
+		writeAlertResponse(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid request"})
+		return
+	}
+
+	var alerts []NewAlert
+	for _, alert := range request.Alerts {
+		alerts = append(alerts, NewAlert{
+			CourseID:      alert.CourseID,
+			SectionNum:    alert.SectionNum,
+			AlertType:     alert.AlertType,
+			SeatThreshold: alert.SeatThreshold,
+			Expression:    alert.Expression,
+		})
+	}
+
+	// read per request so a newly added term is used without restarting the service
+	term, err := GetCurrentTerm(r.Context(), h.pool, h.defaultTerm)
+	if err != nil {
+		log.Println(err)
+		writeAlertResponse(w, http.StatusInternalServerError, map[string]interface{}{"error": "error saving alerts"})
+		return
+	}
+
+	alertIDs, err := CreateAlerts(r.Context(), h.pool, request.UserID, term, alerts)
+	if err != nil {
+		status, kind := alertErrorStatus(err)
+		if kind == nil {
+			log.Println(err)
+			writeAlertResponse(w, status, map[string]interface{}{"error": "error saving alerts"})
+			return
+		}
+		writeAlertResponse(w, status, map[string]interface{}{"error": alertErrorMessage(err, kind)})
+		return
+	}
+
+	log.Printf("Saved %d alerts for user %d", len(alertIDs), request.UserID)
+	writeAlertResponse(w, http.StatusOK, map[string]interface{}{"ids": alertIDs})
+}
@@ -2,99 +2,469 @@ package enrollalert
 
 import (
 	"log"
+	"time"
 
 	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type alertRow struct {
-	userID       int
-	email        string
-	courseID     string
-	courseName   string
-	sectionNum   string
-	alertType    string
+	id            int64
+	userID        int
+	courseID      string
+	sectionNum    string
+	alertType     string
 	seatThreshold *int
-	openSeats    int
+	expression    *string
+	triggerMode   string
+	lastMatched   *bool
+	openSeats     int
+	waitlistOpenSpots int
+
+	// rest of the section's fields for expression alerts
+	section       sectionFields
+
+	// when the section was last scraped, and whether it hasn't matched long enough to fire yet
+	observedAt    time.Time
+	unsettled     bool
+
+	// persistent alert settings and state
+	persistent      bool
+	cooldownMinutes int
+	maxFires        *int
+	fireCount       int
+	lastFiredAt     *time.Time
+	armed           bool
+	expiresAt       *time.Time
+
+	// group whose other alerts are cleared once this one fires and is sent, and when the alert
+	// resumes if it was held or paused by another alert in its group firing
+	groupID         *int64
+	pausedUntil     *time.Time
+}
+
+// result of evaluating an alert against its section's current seat info
+type alertOutcome struct {
+	fire        bool
+	remove      bool
+	armed       bool
+	lastMatched bool
+}
+
+// matches Returns whether the alert's section currently satisfies the alert's condition
+func (alert *alertRow) matches() bool {
+	switch alert.alertType {
+	case "any":
+		return alert.openSeats > 0
+	case "threshold":
+		return alert.seatThreshold != nil && alert.openSeats <= *alert.seatThreshold
+	case "waitlist":
+		return alert.openSeats == 0 && alert.waitlistOpenSpots > 0
+	case "expression":
+		if alert.expression == nil {
+			return false
+		}
+		fields := alert.section
+		fields.CourseID, fields.SectionNum = alert.courseID, alert.sectionNum
+		fields.OpenSeats, fields.WaitlistOpenSpots = alert.openSeats, alert.waitlistOpenSpots
+		matched, err := evalExpression(*alert.expression, &fields)
+		if err != nil {
+			log.Printf("Error with expression for alert %d: %v", alert.id, err)
+		}
+		return matched
+	}
+	return false
+}
+
+// shouldFire Returns whether alert should be sent given if its section currently matches.
+// Edge triggered alerts only fire when the section goes from not matching to matching, so an
+// alert made on a section that's already open waits until the section closes and reopens.
+func (alert *alertRow) shouldFire(matched bool) bool {
+	if alert.triggerMode == "edge" {
+		return matched && alert.lastMatched != nil && !*alert.lastMatched
+	}
+	return matched
+}
+
+// evaluate Decides whether alert fires and what happens to it afterwards. Sections that haven't
+// matched long enough (debouncing) are treated as not matching, and paused or expired alerts
+// don't fire (expired alerts are archived by ExpireAlerts). Non persistent alerts
+// are removed once they fire. Persistent alerts are kept and disarmed when they fire, then re-armed
+// once their section stops matching, and won't fire again until their cooldown has passed.
+// Returns outcome for alert
+func (alert *alertRow) evaluate(now time.Time) alertOutcome {
+
+	matched := alert.matches() && !alert.unsettled
+	outcome := alertOutcome{armed: alert.armed, lastMatched: matched}
+	paused := alert.pausedUntil != nil && now.Before(*alert.pausedUntil)
+
+	if alert.expiresAt != nil && !now.Before(*alert.expiresAt) {
+		return outcome
+	}
+
+	if !alert.persistent {
+		outcome.fire = !paused && alert.shouldFire(matched)
+		outcome.remove = outcome.fire
+		return outcome
+	}
+
+	// section closed again since alert last fired
+	if !matched {
+		outcome.armed = true
+		return outcome
+	}
+
+	cooledDown := alert.lastFiredAt == nil ||
+		now.Sub(*alert.lastFiredAt) >= time.Duration(alert.cooldownMinutes)*time.Minute
+
+	if alert.armed && cooledDown && !paused && alert.shouldFire(matched) {
+		outcome.fire = true
+		outcome.armed = false
+		outcome.remove = alert.maxFires != nil && alert.fireCount+1 >= *alert.maxFires
+	}
+
+	return outcome
 }
 
-// NotifyMatchingAlerts Looks at newly updated courses and sends email alerts to users if the courses
-// now fit their specified alert. Removes course from user's alert list once email is sent.
-// Returns error if issue arrises during querying or email sending.
-func NotifyMatchingAlerts(ctx context.Context, pool *pgxpool.Pool, mail *EmailClient, term int) error {
+// changed Returns whether the outcome changes any of the alert's stored state
+func (alert *alertRow) changed(outcome alertOutcome) bool {
+	return outcome.fire || outcome.armed != alert.armed ||
+		alert.lastMatched == nil || *alert.lastMatched != outcome.lastMatched
+}
+
+// getTermAlerts Queries alerts for given term whose section was updated since given time, along
+// with the section's current seat info. Alerts aren't locked, the ones that change are locked by
+// lockChangedAlerts.
+// Returns list of alerts or error if query fails
+func getTermAlerts(ctx context.Context, tx pgx.Tx, term int, since time.Time) ([]*alertRow, error) {
 
-	// queries any alerts that have been set off by new course seat data
-	rows, err := pool.Query(ctx, `
-		SELECT uc.user_id,
-		       u.email,
+	rows, err := tx.Query(ctx, `
+		SELECT uc.id,
+		       uc.user_id,
 		       uc.course_id,
-		       cs.course_name,
 		       uc.section_num,
 		       uc.alert_type,
 		       uc.seat_threshold,
-		       cs.open_seats
+		       uc.expression,
+		       uc.trigger_mode,
+		       uc.last_matched,
+		       cs.open_seats,
+		       cs.waitlist_open_spots,
+		       cs.last_updated,
+		       cs.course_name,
+		       COALESCE(cs.section_type, ''),
+		       COALESCE(cs.subject_id::int, 0),
+		       COALESCE(cs.prof_name, ''),
+		       COALESCE(cs.capacity, 0),
+		       COALESCE(cs.enrolled, 0),
+		       COALESCE(cs.waitlist_capacity, 0),
+		       uc.persistent,
+		       uc.cooldown_minutes,
+		       uc.max_fires,
+		       uc.fire_count,
+		       uc.last_fired_at,
+		       uc.armed,
+		       uc.expires_at,
+		       uc.group_id,
+		       uc.paused_until
 		FROM user_courses uc
 		JOIN users u ON u.id = uc.user_id
 		JOIN course_sections cs
 		     ON cs.course_id   = uc.course_id
 		    AND cs.section_num = uc.section_num
 		    AND cs.term        = $1
-		WHERE (
-			  uc.alert_type = 'any'      AND cs.open_seats > 0
-		   OR uc.alert_type = 'threshold' AND cs.open_seats <= uc.seat_threshold
-		)
-	`, term)
-
+		WHERE COALESCE(u.email, '') <> ''
+		  AND cs.last_updated >= $2
+		ORDER BY uc.id;
+	`, term, since)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error with alert query: %w", err)
 	}
 	defer rows.Close()
 
-	var count int
-	_ = pool.QueryRow(ctx, `SELECT COUNT(*) FROM course_sections WHERE term=$1`, term).
-						Scan(&count)
-	log.Printf("DEBUG  rows in course_sections for term=%d → %d", term, count)
-
+	var alerts []*alertRow
 	for rows.Next() {
-		var alert alertRow
+		alert := new(alertRow)
 		if err := rows.Scan(
+			&alert.id,
 			&alert.userID,
-			&alert.email,
 			&alert.courseID,
-			&alert.courseName,
 			&alert.sectionNum,
 			&alert.alertType,
 			&alert.seatThreshold,
+			&alert.expression,
+			&alert.triggerMode,
+			&alert.lastMatched,
 			&alert.openSeats,
+			&alert.waitlistOpenSpots,
+			&alert.observedAt,
+			&alert.section.CourseName,
+			&alert.section.SectionType,
+			&alert.section.SubjectID,
+			&alert.section.ProfName,
+			&alert.section.Capacity,
+			&alert.section.Enrolled,
+			&alert.section.WaitlistCapacity,
+			&alert.persistent,
+			&alert.cooldownMinutes,
+			&alert.maxFires,
+			&alert.fireCount,
+			&alert.lastFiredAt,
+			&alert.armed,
+			&alert.expiresAt,
+			&alert.groupID,
+			&alert.pausedUntil,
 		); err != nil {
-			return err
+			return nil, fmt.Errorf("Error with alert row scan: %w", err)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with alert iteration: %w", rows.Err())
+	}
+
+	return alerts, nil
+}
+
+// lockChangedAlerts Locks alerts that are about to be queued, removed or have their state saved,
+// skipping any whose state was changed by another run since they were read.
+// Returns IDs of alerts that were locked
+func lockChangedAlerts(ctx context.Context, tx pgx.Tx, alerts []*alertRow) (map[int64]bool, error) {
+
+	var ids []int64
+	var lastMatched []*bool
+	var armed []bool
+	var fireCounts []int
+	for _, alert := range alerts {
+		ids = append(ids, alert.id)
+		lastMatched = append(lastMatched, alert.lastMatched)
+		armed = append(armed, alert.armed)
+		fireCounts = append(fireCounts, alert.fireCount)
+	}
+
+	// rows are re-checked against their latest version once the lock is taken
+	rows, err := tx.Query(ctx, `
+		SELECT uc.id
+		FROM user_courses uc
+		JOIN unnest($1::bigint[], $2::boolean[], $3::boolean[], $4::int[])
+		     AS seen (id, last_matched, armed, fire_count)
+		     ON seen.id = uc.id
+		WHERE uc.last_matched IS NOT DISTINCT FROM seen.last_matched
+		  AND uc.armed      = seen.armed
+		  AND uc.fire_count = seen.fire_count
+		ORDER BY uc.id
+		FOR UPDATE OF uc;
+	`, ids, lastMatched, armed, fireCounts)
+	if err != nil {
+		return nil, fmt.Errorf("Error with locking alerts: %w", err)
+	}
+	defer rows.Close()
+
+	locked := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Error with locked alert row scan: %w", err)
+		}
+		locked[id] = true
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with locked alert iteration: %w", rows.Err())
+	}
+
+	return locked, nil
+}
+
+// enqueueMatchedAlerts Looks at sections updated since given time and moves any alerts that have
+// been set off by the new seat data into the notification outbox. Alerts are evaluated, queued,
+// deleted or kept (persistent alerts) and have their observed state saved in one transaction so
+// an alert can't be queued without its state being updated. Only alerts that change are locked.
+// Returns number of alerts queued or error if query fails
+func enqueueMatchedAlerts(ctx context.Context, pool DB, term int, since time.Time) (int64, error) {
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Error starting alert transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	alerts, err := getTermAlerts(ctx, tx, term, since)
+	if err != nil {
+		return 0, err
+	}
+
+	// hold back alerts on sections that haven't matched long enough
+	now := time.Now()
+	if err := updateMatchState(ctx, tx, term, alerts, now); err != nil {
+		return 0, err
+	}
+
+	// lock the alerts that will change, another run may have already handled some of them
+	outcomes := make(map[int64]alertOutcome)
+	var changed []*alertRow
+	for _, alert := range alerts {
+		outcome := alert.evaluate(now)
+		if outcome.remove || alert.changed(outcome) {
+			outcomes[alert.id] = outcome
+			changed = append(changed, alert)
 		}
-		if alert.email == "" {
+	}
+	locked, err := lockChangedAlerts(ctx, tx, changed)
+	if err != nil {
+		return 0, err
+	}
+
+	// split alerts into ones to send, ones to remove and ones whose stored state changed
+	var firedIDs, removedIDs, stateIDs []int64
+	var firedKept, stateFired, stateArmed, stateMatched []bool
+	winners := make(map[int64]int64)
+	for _, alert := range changed {
+		if !locked[alert.id] {
 			continue
 		}
+		outcome := outcomes[alert.id]
 
-		data := map[string]interface{}{
-			"course_name": alert.courseName,
-			"section_num": alert.sectionNum,
-			"open_seats":  alert.openSeats,
-			"course_id":   alert.courseID,
+		// only the first alert of a group to fire is sent, the rest of the group is held below.
+		// The others keep their observed state as if they were paused.
+		if outcome.fire && alert.groupID != nil {
+			if _, held := winners[*alert.groupID]; held {
+				outcome = alertOutcome{armed: alert.armed, lastMatched: outcome.lastMatched}
+				if !alert.changed(outcome) {
+					continue
+				}
+			} else {
+				winners[*alert.groupID] = alert.id
+			}
 		}
-		if err := mail.SendSeatAlert(alert.email, data); err != nil {
-			return err
+
+		if outcome.fire {
+			firedIDs = append(firedIDs, alert.id)
+			firedKept = append(firedKept, !outcome.remove)
 		}
 
-		// delete course alert after email is sent
-		if _, err := pool.Exec(ctx, `
-			DELETE FROM user_courses
-			WHERE user_id       = $1
-			  AND course_id     = $2
-			  AND section_num   = $3
-			  AND alert_type    = $4
-			  AND (seat_threshold IS NOT DISTINCT FROM $5)
-		`, alert.userID, alert.courseID, alert.sectionNum, alert.alertType, alert.seatThreshold); err != nil {
-			return err
+		if outcome.remove {
+			removedIDs = append(removedIDs, alert.id)
+		} else if alert.changed(outcome) {
+			stateIDs = append(stateIDs, alert.id)
+			stateFired = append(stateFired, outcome.fire)
+			stateArmed = append(stateArmed, outcome.armed)
+			stateMatched = append(stateMatched, outcome.lastMatched)
 		}
 	}
-	return rows.Err()
+
+	// queue fired alerts
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO notification_outbox (
+			idempotency_key, user_id, email, term, course_id, course_name, section_num,
+			alert_type, seat_threshold, open_seats, waitlist_open_spots, waitlist_capacity, alert_kept,
+			alert_id, expression, cleared_alternatives, alternatives_paused_minutes, chat_webhook_ids,
+			alert_snapshot, group_id
+		)
+		SELECT gen_random_uuid()::text, uc.user_id, u.email, cs.term, uc.course_id, cs.course_name,
+		       uc.section_num, uc.alert_type, uc.seat_threshold, cs.open_seats,
+		       cs.waitlist_open_spots, cs.waitlist_capacity, fired.kept,
+		       CASE WHEN fired.kept THEN uc.id END, uc.expression,
+		       -- rest of the alert's group, which is cleared once the alert is sent
+		       ARRAY(
+		           SELECT COALESCE(ocs.course_name, other.course_id) || ' section ' || other.section_num
+		           FROM user_courses other
+		           LEFT JOIN course_sections ocs
+		                ON ocs.course_id   = other.course_id
+		               AND ocs.section_num = other.section_num
+		               AND ocs.term        = $3
+		           WHERE other.group_id = uc.group_id
+		             AND other.id <> uc.id
+		           ORDER BY other.id
+		       ),
+		       CASE WHEN g.on_fire = 'pause' THEN g.pause_minutes END,
+		       ARRAY(SELECT acw.chat_webhook_id FROM alert_chat_webhooks acw WHERE acw.alert_id = uc.id),
+		       -- removed alerts can be restored if they turn out to be stale when re-checked
+		       CASE WHEN NOT fired.kept THEN to_jsonb(uc) END,
+		       uc.group_id
+		FROM unnest($1::bigint[], $2::boolean[]) AS fired (id, kept)
+		JOIN user_courses uc ON uc.id = fired.id
+		LEFT JOIN alert_groups g ON g.id = uc.group_id
+		JOIN users u ON u.id = uc.user_id
+		JOIN course_sections cs
+		     ON cs.course_id   = uc.course_id
+		    AND cs.section_num = uc.section_num
+		    AND cs.term        = $3;
+	`, firedIDs, firedKept, term)
+	if err != nil {
+		return 0, fmt.Errorf("Error with queueing matched alerts: %w", err)
+	}
+
+	// remove fired and expired alerts from user's alert list
+	if _, err := tx.Exec(ctx, `DELETE FROM user_courses WHERE id = ANY($1)`, removedIDs); err != nil {
+		return 0, fmt.Errorf("Error with deleting matched alerts: %w", err)
+	}
+
+	// save fire count, armed state and last observed state for kept alerts
+	if _, err := tx.Exec(ctx, `
+		UPDATE user_courses uc
+		SET fire_count    = uc.fire_count + state.fired::int,
+		    last_fired_at = CASE WHEN state.fired THEN CURRENT_TIMESTAMP ELSE uc.last_fired_at END,
+		    armed         = state.armed,
+		    last_matched  = state.matched
+		FROM unnest($1::bigint[], $2::boolean[], $3::boolean[], $4::boolean[])
+		     AS state (id, fired, armed, matched)
+		WHERE uc.id = state.id;
+	`, stateIDs, stateFired, stateArmed, stateMatched); err != nil {
+		return 0, fmt.Errorf("Error with updating alert state: %w", err)
+	}
+
+	if err := holdGroupAlternatives(ctx, tx, winners); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("Error committing alert transaction: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
 }
 
+// NotifyMatchingAlerts Looks at sections updated since given time (the scrape's start) and queues
+// alerts for users whose alerts now match, removing them from the user's alert list unless they're
+// persistent. Queued alerts are then sent by email (unless the user's email is suppressed) and
+// through any additional notifiers (webhooks, etc.) the user has set up.
+// Returns error if issue arrises during querying or queueing.
+func NotifyMatchingAlerts(ctx context.Context, pool *pgxpool.Pool, mail *EmailClient, term int, since time.Time,
+	notifiers ...Notifier) error {
+
+	// archive expired alerts before matching so they can't fire
+	expired, notified, err := ExpireAlerts(ctx, pool, term)
+	if err != nil {
+		return err
+	}
+	log.Printf("Expired %d alerts (%d expired without going off)", expired, notified)
+
+	queued, err := enqueueMatchedAlerts(ctx, pool, term, since)
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued %d matched alerts for term=%d", queued, term)
+
+	// queue course level alerts that now have an open enrollment package
+	queued, err = queuePackageAlerts(ctx, pool, term)
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued %d package alerts for term=%d", queued, term)
+
+	// queue saved searches that now have an open section
+	queued, err = queueSearchAlerts(ctx, pool, term)
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued %d search alerts for term=%d", queued, term)
+
+	// email is always the first channel alerts are sent through
+	channels := append([]Notifier{mail}, notifiers...)
+
+	return DispatchOutbox(ctx, pool, channels)
+}
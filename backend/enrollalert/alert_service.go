@@ -0,0 +1,189 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errors returned when an alert can't be created, wrapped with details for the user
+var (
+	ErrInvalidAlert    = errors.New("invalid alert")
+	ErrSectionNotFound = errors.New("section not found")
+	ErrDuplicateAlert  = errors.New("alert already saved")
+	ErrAlertQuota      = errors.New("alert limit reached")
+)
+
+// NewAlert is an alert a user wants to save on a section
+type NewAlert struct {
+	CourseID      string
+	SectionNum    string
+	AlertType     string // any, threshold, waitlist or expression
+	SeatThreshold *int   // threshold alerts only
+	Expression    string // expression alerts only
+}
+
+// validate Checks that alert has a section and that its threshold or expression fits its type.
+// Returns error describing what's wrong with the alert
+func (alert *NewAlert) validate() error {
+
+	if alert.CourseID == "" || alert.SectionNum == "" {
+		return fmt.Errorf("%w: alert needs a course and section", ErrInvalidAlert)
+	}
+
+	switch alert.AlertType {
+	case "any", "threshold", "waitlist", "expression":
+	default:
+		return fmt.Errorf("%w: unknown alert type %q", ErrInvalidAlert, alert.AlertType)
+	}
+
+	if alert.AlertType == "threshold" {
+		if alert.SeatThreshold == nil || *alert.SeatThreshold < 1 {
+			return fmt.Errorf("%w: seat threshold must be at least 1", ErrInvalidAlert)
+		}
+	} else if alert.SeatThreshold != nil {
+		return fmt.Errorf("%w: only threshold alerts have a seat threshold", ErrInvalidAlert)
+	}
+
+	if alert.AlertType == "expression" {
+		if err := ValidateAlertExpression(alert.Expression); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidAlert, err)
+		}
+	} else if alert.Expression != "" {
+		return fmt.Errorf("%w: only expression alerts have an expression", ErrInvalidAlert)
+	}
+
+	return nil
+}
+
+// key Returns string identifying alerts that are duplicates of each other
+func (alert *NewAlert) key() string {
+	threshold := 0
+	if alert.SeatThreshold != nil {
+		threshold = *alert.SeatThreshold
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%s", alert.CourseID, alert.SectionNum, alert.AlertType, threshold, alert.Expression)
+}
+
+// alertConstraintError Converts a violated user_courses constraint into the matching alert error.
+// Returns err unchanged if it isn't a constraint violation
+func alertConstraintError(alert *NewAlert, err error) error {
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch pgErr.ConstraintName {
+	case "user_courses_quota":
+		return fmt.Errorf("%w: %s", ErrAlertQuota, pgErr.Message)
+	case "user_courses_unique_idx":
+		return fmt.Errorf("%w: %s section %s", ErrDuplicateAlert, alert.CourseID, alert.SectionNum)
+	case "user_courses_section_fkey", "user_courses_section_term":
+		return fmt.Errorf("%w: %s section %s", ErrSectionNotFound, alert.CourseID, alert.SectionNum)
+	case "user_courses_alert_type_check", "user_courses_threshold_check", "user_courses_expression_check":
+		return fmt.Errorf("%w: %s", ErrInvalidAlert, pgErr.Message)
+	}
+
+	return err
+}
+
+// CreateAlerts Validates and saves alerts for the user, all or none of them. Every alert's section
+// must exist in given term, the user can't already have the same alert and the user's tier must
+// have room for all of them. The DB enforces the same rules for anything that writes alerts directly.
+// Returns IDs of new alerts in order, or error wrapping ErrInvalidAlert, ErrSectionNotFound,
+// ErrDuplicateAlert or ErrAlertQuota if an alert isn't allowed
+func CreateAlerts(ctx context.Context, pool DB, userID int, term int, alerts []NewAlert) ([]int64, error) {
+
+	if len(alerts) == 0 {
+		return nil, fmt.Errorf("%w: no alerts given", ErrInvalidAlert)
+	}
+
+	seen := make(map[string]bool)
+	for i := range alerts {
+		if err := alerts[i].validate(); err != nil {
+			return nil, err
+		}
+		if seen[alerts[i].key()] {
+			return nil, fmt.Errorf("%w: %s section %s is listed twice", ErrDuplicateAlert,
+				alerts[i].CourseID, alerts[i].SectionNum)
+		}
+		seen[alerts[i].key()] = true
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting alert transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// lock the user so concurrent requests can't both fit under the quota
+	var quota, existing int
+	if err := tx.QueryRow(ctx, `
+		SELECT t.max_alerts,
+		       (SELECT count(*) FROM user_courses uc WHERE uc.user_id = u.id)
+		FROM users u
+		JOIN alert_tiers t ON t.tier = u.tier
+		WHERE u.id = $1
+		FOR UPDATE OF u;
+	`, userID).Scan(&quota, &existing); err != nil {
+		return nil, fmt.Errorf("Error getting alert quota for user %d: %w", userID, err)
+	}
+	if existing+len(alerts) > quota {
+		return nil, fmt.Errorf("%w: you can only save up to %d alerts (you have %d)", ErrAlertQuota, quota, existing)
+	}
+
+	var alertIDs []int64
+	for i := range alerts {
+		alert := &alerts[i]
+
+		var sectionExists, duplicate bool
+		if err := tx.QueryRow(ctx, `
+			SELECT EXISTS (
+			         SELECT 1 FROM course_sections
+			         WHERE term = $2 AND course_id = $3 AND section_num = $4
+			       ),
+			       EXISTS (
+			         SELECT 1 FROM user_courses
+			         WHERE user_id     = $1
+			           AND course_id   = $3
+			           AND section_num = $4
+			           AND alert_type  = $5
+			           AND seat_threshold IS NOT DISTINCT FROM $6
+			           AND expression     IS NOT DISTINCT FROM NULLIF($7, '')
+			       );
+		`, userID, term, alert.CourseID, alert.SectionNum, alert.AlertType, alert.SeatThreshold,
+			alert.Expression).Scan(&sectionExists, &duplicate); err != nil {
+			return nil, fmt.Errorf("Error checking alert for %s section %s: %w", alert.CourseID, alert.SectionNum, err)
+		}
+		if !sectionExists {
+			return nil, fmt.Errorf("%w: %s section %s in term %d", ErrSectionNotFound, alert.CourseID,
+				alert.SectionNum, term)
+		}
+		if duplicate {
+			return nil, fmt.Errorf("%w: %s section %s", ErrDuplicateAlert, alert.CourseID, alert.SectionNum)
+		}
+
+		var alertID int64
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO user_courses (user_id, course_id, section_num, alert_type, seat_threshold, expression)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+			RETURNING id;
+		`, userID, alert.CourseID, alert.SectionNum, alert.AlertType, alert.SeatThreshold,
+			alert.Expression).Scan(&alertID); err != nil {
+			// rules the DB enforces are returned as is so their messages can be shown to the user
+			if constraintErr := alertConstraintError(alert, err); constraintErr != err {
+				return nil, constraintErr
+			}
+			return nil, fmt.Errorf("Error saving alert for %s section %s: %w", alert.CourseID, alert.SectionNum, err)
+		}
+		alertIDs = append(alertIDs, alertID)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("Error committing alert transaction: %w", err)
+	}
+
+	return alertIDs, nil
+}
@@ -0,0 +1,340 @@
+package enrollalert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	chatTimeout       = 10 * time.Second
+	chatMaxRetryAfter = 30 * time.Second
+	discordEmbedColor = 0x2563eb
+)
+
+type chatWebhook struct {
+	id       int64
+	platform string
+	url      string
+}
+
+type ChatNotifier struct {
+	pool   *pgxpool.Pool
+	client *http.Client
+}
+
+// NewChatNotifier creates notifier that posts seat alerts to Discord and Slack incoming webhooks
+func NewChatNotifier(pool *pgxpool.Pool) *ChatNotifier {
+	return &ChatNotifier{pool: pool, client: newPublicHTTPClient(chatTimeout)}
+}
+
+// Channel Returns name of chat notification channel
+func (c *ChatNotifier) Channel() string {
+	return "chat"
+}
+
+// enrollURL Returns course search URL for the alert's course
+func enrollURL(alert *SeatAlert) string {
+	return getReferrer(strconv.Itoa(alert.Term), alert.CourseName)
+}
+
+// discordMessage Builds Discord webhook message with an embed and an "Enroll" link button.
+// Returns message body
+func discordMessage(alert *SeatAlert) map[string]interface{} {
+	return map[string]interface{}{
+		"username": "EnrollAlert",
+		"embeds": []interface{}{
+			map[string]interface{}{
+				"title":       alert.title(),
+				"url":         enrollURL(alert),
+				"description": alert.summary(),
+				"color":       discordEmbedColor,
+				"timestamp":   alert.Timestamp.UTC().Format(time.RFC3339),
+				"fields": []interface{}{
+					map[string]interface{}{"name": "Course", "value": alert.CourseName, "inline": true},
+					map[string]interface{}{"name": "Section", "value": alert.SectionNum, "inline": true},
+					map[string]interface{}{"name": "Open Seats", "value": strconv.Itoa(alert.OpenSeats), "inline": true},
+					map[string]interface{}{"name": "Waitlist Spots", "value": strconv.Itoa(alert.WaitlistOpenSpots), "inline": true},
+				},
+				"footer": map[string]interface{}{"text": "Sent by EnrollAlert"},
+			},
+		},
+
+		// link buttons are only rendered when the webhook is called with_components=true
+		"components": []interface{}{
+			map[string]interface{}{
+				"type": 1,
+				"components": []interface{}{
+					map[string]interface{}{"type": 2, "style": 5, "label": "Enroll", "url": enrollURL(alert)},
+				},
+			},
+		},
+	}
+}
+
+// slackMessage Builds Slack webhook message using Block Kit with an "Enroll" button.
+// Returns message body
+func slackMessage(alert *SeatAlert) map[string]interface{} {
+
+	return map[string]interface{}{
+		"text": fmt.Sprintf("%s: %s", alert.CourseName, alert.summary()),
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "header",
+				"text": map[string]interface{}{"type": "plain_text", "text": alert.title()},
+			},
+			map[string]interface{}{
+				"type": "section",
+				"fields": []interface{}{
+					map[string]interface{}{"type": "mrkdwn", "text": "*Course*\n" + alert.CourseName},
+					map[string]interface{}{"type": "mrkdwn", "text": "*Section*\n" + alert.SectionNum},
+					map[string]interface{}{"type": "mrkdwn", "text": "*Open Seats*\n" + strconv.Itoa(alert.OpenSeats)},
+					map[string]interface{}{"type": "mrkdwn", "text": "*Waitlist Spots*\n" + strconv.Itoa(alert.WaitlistOpenSpots)},
+				},
+			},
+			map[string]interface{}{
+				"type": "actions",
+				"elements": []interface{}{
+					map[string]interface{}{
+						"type":  "button",
+						"text":  map[string]interface{}{"type": "plain_text", "text": "Enroll"},
+						"url":   enrollURL(alert),
+						"style": "primary",
+					},
+				},
+			},
+		},
+	}
+}
+
+// getAlertChatWebhooks Queries chat webhooks that were attached to given user's alert when it
+// was queued.
+// Returns list of chat webhooks or error if query fails
+func (c *ChatNotifier) getAlertChatWebhooks(ctx context.Context, userID int, alert *SeatAlert) ([]chatWebhook, error) {
+
+	if len(alert.ChatWebhookIDs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := c.pool.Query(ctx, `
+		SELECT id, platform, url
+		FROM chat_webhooks
+		WHERE user_id = $1
+		  AND id = ANY($2);
+	`, userID, alert.ChatWebhookIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Error with chat webhook query: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []chatWebhook
+	for rows.Next() {
+		var hook chatWebhook
+		if err := rows.Scan(&hook.id, &hook.platform, &hook.url); err != nil {
+			return nil, fmt.Errorf("Error with chat webhook row scan: %w", err)
+		}
+		webhooks = append(webhooks, hook)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with chat webhook iteration: %w", rows.Err())
+	}
+
+	return webhooks, nil
+}
+
+// postChatMessage Posts message to chat webhook, waiting and retrying once if rate limited.
+// Returns error if message isn't accepted
+func (c *ChatNotifier) postChatMessage(ctx context.Context, hookURL string, body []byte) error {
+
+	// second attempt always returns, whether or not it's rate limited again
+	for attempt := 0; ; attempt++ {
+
+		request, err := http.NewRequestWithContext(ctx, "POST", hookURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("Error while creating POST request: %w", err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		response, err := c.client.Do(request)
+		if err != nil {
+			return fmt.Errorf("Error sending request: %w", err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			return nil
+		}
+		if response.StatusCode != http.StatusTooManyRequests || attempt > 0 {
+			return fmt.Errorf("Chat webhook responded with status %d", response.StatusCode)
+		}
+
+		// both Discord and Slack send seconds to wait in Retry-After header
+		wait := time.Second
+		if seconds, err := strconv.ParseFloat(response.Header.Get("Retry-After"), 64); err == nil {
+			wait = time.Duration(seconds * float64(time.Second))
+		}
+		if wait > chatMaxRetryAfter {
+			return fmt.Errorf("Chat webhook rate limited for %s", wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Notify Posts formatted seat alert to every Discord or Slack webhook attached to the alert that
+// it hasn't already been posted to.
+// Returns ErrNoTargets if no webhooks are attached to the alert, or error if webhooks can't be
+// queried or any post fails
+func (c *ChatNotifier) Notify(ctx context.Context, userID int, alert *SeatAlert) (string, error) {
+
+	webhooks, err := c.getAlertChatWebhooks(ctx, userID, alert)
+	if err != nil {
+		return "", err
+	}
+	if len(webhooks) == 0 {
+		return "", ErrNoTargets
+	}
+
+	var firstErr error
+	for _, hook := range webhooks {
+		target := targetKey(c.Channel(), hook.id)
+		if alert.sentTo(target) {
+			continue
+		}
+
+		// build message for webhook's platform
+		var message map[string]interface{}
+		hookURL := hook.url
+		switch hook.platform {
+		case "discord":
+			message = discordMessage(alert)
+			if parsed, err := url.Parse(hook.url); err == nil {
+				query := parsed.Query()
+				query.Set("with_components", "true")
+				parsed.RawQuery = query.Encode()
+				hookURL = parsed.String()
+			}
+		case "slack":
+			message = slackMessage(alert)
+		default:
+			log.Printf("Unknown chat platform %q for webhook %d", hook.platform, hook.id)
+			continue
+		}
+
+		body, err := json.Marshal(message)
+		if err != nil {
+			return "", fmt.Errorf("Error with chat message marshal: %w", err)
+		}
+
+		if err := c.postChatMessage(ctx, hookURL, body); err != nil {
+			log.Printf("Chat webhook %d delivery failed for user %d: %v", hook.id, userID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if err := markTargetSent(ctx, c.pool, alert, target); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return "", firstErr
+}
+
+// validateChatWebhookURL Checks that url is an incoming webhook URL for the platform.
+// Returns error describing what's wrong with the URL
+func validateChatWebhookURL(platform string, rawURL string) error {
+
+	if err := requireHTTPS(rawURL); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(rawURL)
+
+	switch platform {
+	case "discord":
+		host := parsed.Hostname()
+		if (host != "discord.com" && host != "discordapp.com") || !strings.HasPrefix(parsed.Path, "/api/webhooks/") {
+			return errors.New("Discord webhook URLs look like https://discord.com/api/webhooks/...")
+		}
+	case "slack":
+		if parsed.Hostname() != "hooks.slack.com" {
+			return errors.New("Slack webhook URLs look like https://hooks.slack.com/services/...")
+		}
+	default:
+		return fmt.Errorf("Unknown chat platform %q", platform)
+	}
+
+	return nil
+}
+
+// AttachChatWebhook Saves a Discord or Slack webhook for the user (reusing it if the user already
+// saved the URL) and attaches it to the user's given alerts.
+// Returns ID of chat webhook or error if URL is invalid or any alert isn't the user's
+func AttachChatWebhook(ctx context.Context, pool DB, userID int, platform string, hookURL string, label string,
+	alertIDs []int64) (int64, error) {
+
+	if err := validateChatWebhookURL(platform, hookURL); err != nil {
+		return 0, err
+	}
+	if len(alertIDs) == 0 {
+		return 0, errors.New("Chat webhook needs at least one alert to attach to")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Error starting chat webhook transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var hookID int64
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO chat_webhooks (user_id, platform, url, label)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (user_id, url)
+		DO UPDATE SET platform = EXCLUDED.platform, label = COALESCE(EXCLUDED.label, chat_webhooks.label)
+		RETURNING id;
+	`, userID, platform, hookURL, label).Scan(&hookID); err != nil {
+		return 0, fmt.Errorf("Error saving chat webhook: %w", err)
+	}
+
+	// only attach to alerts that belong to the user
+	var owned int
+	if err := tx.QueryRow(ctx, `
+		SELECT count(*) FROM user_courses WHERE user_id = $1 AND id = ANY($2);
+	`, userID, alertIDs).Scan(&owned); err != nil {
+		return 0, fmt.Errorf("Error checking alerts for chat webhook: %w", err)
+	}
+	slices.Sort(alertIDs)
+	if alertIDs = slices.Compact(alertIDs); owned != len(alertIDs) {
+		return 0, fmt.Errorf("Only %d of %d alerts belong to user %d", owned, len(alertIDs), userID)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO alert_chat_webhooks (chat_webhook_id, alert_id)
+		SELECT $1, unnest($2::bigint[])
+		ON CONFLICT DO NOTHING;
+	`, hookID, alertIDs); err != nil {
+		return 0, fmt.Errorf("Error attaching chat webhook to alerts: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("Error committing chat webhook transaction: %w", err)
+	}
+
+	return hookID, nil
+}
@@ -0,0 +1,197 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"github.com/jackc/pgx/v5"
+)
+
+// returned when a course alert is for a course that has never had sections, or a package alert is
+// for a course without enrollment packages in the term
+var ErrCourseNotFound = errors.New("course not found")
+
+// CreateCourseAlert Validates and saves a course level alert for the user. The course must have
+// had sections scraped, kind must be new_section or any_package and sectionType (e.g. LAB) is
+// optional. Package alerts also need the course to have enrollment packages in the term.
+// Returns ID of new alert, or error wrapping ErrInvalidAlert, ErrCourseNotFound or
+// ErrDuplicateAlert if the alert isn't allowed
+func CreateCourseAlert(ctx context.Context, pool DB, userID int, term int, courseID string, kind string, sectionType string) (int64, error) {
+
+	if courseID == "" {
+		return 0, fmt.Errorf("%w: alert needs a course", ErrInvalidAlert)
+	}
+	if kind != "new_section" && kind != "any_package" {
+		return 0, fmt.Errorf("%w: unknown course alert kind %q", ErrInvalidAlert, kind)
+	}
+
+	var sectionTypeArg *string
+	if sectionType = strings.ToUpper(strings.TrimSpace(sectionType)); sectionType != "" {
+		sectionTypeArg = &sectionType
+	}
+
+	// sections left over from earlier terms count, the course's sections for this term may not exist yet
+	var courseExists, hasPackages bool
+	if err := pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM course_sections WHERE course_id = $1),
+		       EXISTS (SELECT 1 FROM course_packages WHERE course_id = $1 AND term = $2);
+	`, courseID, term).Scan(&courseExists, &hasPackages); err != nil {
+		return 0, fmt.Errorf("Error checking course %s: %w", courseID, err)
+	}
+	if !courseExists {
+		return 0, fmt.Errorf("%w: %s", ErrCourseNotFound, courseID)
+	}
+	if kind == "any_package" && !hasPackages {
+		return 0, fmt.Errorf("%w: %s has no enrollment packages in term %d", ErrCourseNotFound, courseID, term)
+	}
+
+	var alertID int64
+	err := pool.QueryRow(ctx, `
+		INSERT INTO course_alerts (user_id, course_id, term, alert_kind, section_type)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+		RETURNING id;
+	`, userID, courseID, term, kind, sectionTypeArg).Scan(&alertID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("%w: %s alert for %s", ErrDuplicateAlert, kind, courseID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error saving course alert for %s: %w", courseID, err)
+	}
+
+	return alertID, nil
+}
+
+// QueueNewSectionAlerts Queues alerts for users with a new section alert on a course that had
+// sections added or had a section's capacity raised during the latest scrape, filtered by section
+// type if the alert has one. Alerts are removed once queued, one outbox entry is queued for each
+// section the alert matches.
+// Returns error if queueing fails
+func QueueNewSectionAlerts(ctx context.Context, pool DB, term int, newSections []NewSection) error {
+
+	if len(newSections) == 0 {
+		return nil
+	}
+
+	// split new sections into columns to pass in as arrays
+	var courseIDs, courseNames, sectionNums, sectionTypes, profNames []string
+	var capacities, openSeats []int
+	var oldCapacities []*int
+	for _, section := range newSections {
+		courseIDs = append(courseIDs, section.CourseID)
+		courseNames = append(courseNames, section.CourseName)
+		sectionNums = append(sectionNums, section.SectionNum)
+		sectionTypes = append(sectionTypes, section.SectionType)
+		profNames = append(profNames, section.ProfName)
+		capacities = append(capacities, section.Capacity)
+		openSeats = append(openSeats, section.OpenSeats)
+
+		// only sections whose capacity was raised have an old capacity
+		var oldCapacity *int
+		if section.CapacityRaised {
+			oldCapacity = &section.OldCapacity
+		}
+		oldCapacities = append(oldCapacities, oldCapacity)
+	}
+
+	tag, err := pool.Exec(ctx, `
+		WITH new_sections AS (
+			SELECT *
+			FROM unnest($2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::int[], $8::int[],
+			            $9::int[])
+			     AS ns (course_id, course_name, section_num, section_type, prof_name, capacity, open_seats,
+			            old_capacity)
+		),
+		fired AS (
+			SELECT ca.id, ca.user_id, u.email, ns.*
+			FROM course_alerts ca
+			JOIN users u ON u.id = ca.user_id
+			JOIN new_sections ns
+			     ON ns.course_id = ca.course_id
+			    AND (ca.section_type IS NULL OR ca.section_type = ns.section_type)
+			WHERE ca.term       = $1
+			  AND ca.alert_kind = 'new_section'
+			  AND COALESCE(u.email, '') <> ''
+			FOR UPDATE OF ca
+		),
+		removed AS (
+			DELETE FROM course_alerts WHERE id IN (SELECT id FROM fired)
+		)
+		INSERT INTO notification_outbox (
+			idempotency_key, user_id, email, term, course_id, course_name, section_num,
+			alert_type, open_seats, section_type, capacity, prof_name, old_capacity
+		)
+		SELECT gen_random_uuid()::text, user_id, email, $1, course_id, course_name, section_num,
+		       'new_section', open_seats, section_type, capacity, prof_name, old_capacity
+		FROM fired;
+	`, term, courseIDs, courseNames, sectionNums, sectionTypes, profNames, capacities, openSeats, oldCapacities)
+
+	if err != nil {
+		return fmt.Errorf("Error with queueing new section alerts: %w", err)
+	}
+
+	log.Printf("Queued %d new section alerts for %d new or raised capacity sections", tag.RowsAffected(), len(newSections))
+
+	return nil
+}
+
+// queuePackageAlerts Queues alerts for users with an any package alert on a course that now has
+// an enrollment package with every one of its sections open (or every section of the alert's
+// section type). Each alert is queued once with the package that has the most open seats, and is
+// removed in the same statement so it can't be queued twice.
+// Returns number of alerts queued or error if queueing fails
+func queuePackageAlerts(ctx context.Context, pool DB, term int) (int64, error) {
+
+	tag, err := pool.Exec(ctx, `
+		WITH open_packages AS (
+			SELECT ca.id AS alert_id,
+			       ca.user_id,
+			       u.email,
+			       p.course_id,
+			       max(cs.course_name) AS course_name,
+			       string_agg(cs.section_type || ' ' || cs.section_num, ' + '
+			                  ORDER BY cs.section_type, cs.section_num) AS sections,
+			       min(cs.open_seats) AS open_seats
+			FROM course_alerts ca
+			JOIN users u ON u.id = ca.user_id
+			JOIN course_packages p
+			     ON p.course_id = ca.course_id
+			    AND p.term      = ca.term
+			JOIN course_sections cs
+			     ON cs.course_id   = p.course_id
+			    AND cs.term        = p.term
+			    AND cs.section_num = ANY(p.section_nums)
+			WHERE ca.term       = $1
+			  AND ca.alert_kind = 'any_package'
+			  AND COALESCE(u.email, '') <> ''
+			  AND (ca.section_type IS NULL OR cs.section_type = ca.section_type)
+			GROUP BY ca.id, ca.user_id, u.email, p.course_id, p.package_key
+			HAVING bool_and(cs.open_seats > 0)
+		),
+		fired AS (
+			SELECT DISTINCT ON (alert_id) *
+			FROM open_packages
+			ORDER BY alert_id, open_seats DESC
+		),
+		removed AS (
+			DELETE FROM course_alerts WHERE id IN (SELECT alert_id FROM fired)
+			RETURNING id
+		)
+		INSERT INTO notification_outbox (
+			idempotency_key, user_id, email, term, course_id, course_name, section_num,
+			alert_type, open_seats
+		)
+		SELECT gen_random_uuid()::text, fired.user_id, fired.email, $1, fired.course_id,
+		       fired.course_name, fired.sections, 'any_package', fired.open_seats
+		FROM fired
+		JOIN removed ON removed.id = fired.alert_id;
+	`, term)
+
+	if err != nil {
+		return 0, fmt.Errorf("Error with queueing package alerts: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
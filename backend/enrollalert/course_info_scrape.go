@@ -7,21 +7,22 @@ import (
 	"io/ioutil"
 	"context"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"github.com/corpix/uarand"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // structure of each section returned by API
 type Section struct {
-	CourseID      string `json:"courseId`
-	CatalogNumber string `json:"catalogNumber`
+	CourseID      string `json:"courseId"`
+	CatalogNumber string `json:"catalogNumber"`
 	SectionNumber	string `json:"sectionNumber"`
 	ClassType     string `json:"type"`
 
 	// structure of subject section
 	Subject struct {
-		SubjectID  int    `json:subjectCode`
+		SubjectID  int    `json:"-"`
 		ShortDesc  string `json:"shortDescription"`
 	} `json:"subject"`
 
@@ -39,8 +40,8 @@ type Section struct {
 		CurrentlyEnrolled     int    `json:"currentlyEnrolled"`
 		OpenSeats             int    `json:"openSeats"`
 		WaitlistOpenSpots     int    `json:"openWaitlistSpots"`
-		WaitlistCapacity		  int    `json:"aggregateWaitlistCapacity`
-	} `json:"enrollmentStatus`	
+		WaitlistCapacity		  int    `json:"aggregateWaitlistCapacity"`
+	} `json:"enrollmentStatus"`	
 }
 
 // overall response structure
@@ -48,6 +49,16 @@ type EnrollmentPackage struct {
 	Sections []Section	`json:"sections"`
 }
 
+// sectionNums Returns sorted section numbers of every section in the package
+func (enrollmentPackage *EnrollmentPackage) sectionNums() []string {
+	var sectionNums []string
+	for _, section := range enrollmentPackage.Sections {
+		sectionNums = append(sectionNums, section.SectionNumber)
+	}
+	sort.Strings(sectionNums)
+	return sectionNums
+}
+
 // hold all enrollment packages (sections) for a particular course
 type Course struct {
 	EnrollmentPackages []*EnrollmentPackage 
@@ -100,6 +111,14 @@ func getSectionInfo(courseCodes *CourseCodes) ([]*EnrollmentPackage, error) {
 		log.Printf("No sections found for course %s.", courseCodes.CourseName)
 	}
 
+	// subject code isn't parsed from the response, use the one the request was built with
+	subjectID, _ := strconv.Atoi(courseCodes.SubjectID)
+	for i := range sections {
+		for j := range sections[i].Sections {
+			sections[i].Sections[j].Subject.SubjectID = subjectID
+		}
+	}
+
 	// get pointers to each section
 	var sectionPtrs []*EnrollmentPackage
 	for i := range sections {
@@ -112,7 +131,7 @@ func getSectionInfo(courseCodes *CourseCodes) ([]*EnrollmentPackage, error) {
 // markHasSectionInSectionCache Updates course cache table with if given course has a section
 // or not so redundant scraping can be avoided
 // Returns error if failure in updating table
-func markHasSectionInSectionCache(pool *pgxpool.Pool, courseID string, hasSection bool) error {
+func markHasSectionInSectionCache(pool DB, courseID string, hasSection bool) error {
 
 	// update section cache table with if course has a section
 	_, err := pool.Exec(context.Background(), `
@@ -130,9 +149,9 @@ func markHasSectionInSectionCache(pool *pgxpool.Pool, courseID string, hasSectio
 }
 
 // courseInfoScrape Scrape section informaiton from given courses from UW-Madison 
-// enrollment API using goroutines. 
+// enrollment API using goroutines. Section cache isn't updated if pool is nil.
 // Returns a list of pointers to Course objects containing section information for course
-func courseInfoScrape(pool *pgxpool.Pool, courseCodes []*CourseCodes) []*Course {
+func courseInfoScrape(pool DB, courseCodes []*CourseCodes) []*Course {
 
 	var waitGroup  sync.WaitGroup
 	var mutex      sync.Mutex
@@ -166,15 +185,12 @@ func courseInfoScrape(pool *pgxpool.Pool, courseCodes []*CourseCodes) []*Course
 					CourseTitle:        courseCode.CourseTitle,
 				}
 
-				// update section status for whether or not a course has sections
-				if len(enrollmentPackages) == 0 {
-					err = markHasSectionInSectionCache(pool, courseCode.CourseID, false)
-				} else {
-					err = markHasSectionInSectionCache(pool, courseCode.CourseID, true)
-				}
-
-				if err != nil {
-					log.Printf("Error updating cache for %s: %v\n", courseCode.CourseID, err)
+				// update section status for whether or not a course has sections (not in dry runs)
+				if pool != nil {
+					err = markHasSectionInSectionCache(pool, courseCode.CourseID, len(enrollmentPackages) > 0)
+					if err != nil {
+						log.Printf("Error updating cache for %s: %v\n", courseCode.CourseID, err)
+					}
 				}
 
 				mutex.Lock()
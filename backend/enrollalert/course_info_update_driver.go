@@ -3,9 +3,9 @@ package enrollalert
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 	"log"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type CourseCodes struct {
@@ -15,6 +15,39 @@ type CourseCodes struct {
 	CourseTitle    string
 }
 
+// section that didn't exist in the DB for the current term before the current scrape, or an
+// existing section whose capacity was raised
+type NewSection struct {
+	CourseID       string
+	CourseName     string
+	SectionNum     string
+	SectionType    string
+	Capacity       int
+	OpenSeats      int
+	ProfName       string
+	CapacityRaised bool
+	OldCapacity    int // capacity before it was raised
+}
+
+// existing section whose seat counts changed in the current scrape
+type SectionChange struct {
+	CourseID             string
+	CourseName           string
+	SectionNum           string
+	OldOpenSeats         int
+	OpenSeats            int
+	OldWaitlistOpenSpots int
+	WaitlistOpenSpots    int
+}
+
+// changes detected while updating course sections with scraped info
+type ScrapeDiff struct {
+	StartedAt   time.Time // by the DB's clock, sections updated since were part of the scrape
+	Upserted    int
+	NewSections []NewSection
+	Changes     []SectionChange
+}
+
 // batchCourseIDs is a helper function that creates batches of size batchSize
 // of course IDs and returns them
 // returns a list of batches of course IDs
@@ -38,7 +71,7 @@ func batchCourseIDs(courseIDs []*CourseCodes, batchSize int) [][]*CourseCodes {
 
 // getCourseCodesFromDB Queries course and subject codes using course name and creates a list of
 // returns a list of pointers to CourseCodes containing course information
-func getCourseCodesFromDB(pool *pgxpool.Pool, courseIDs []string) ([]*CourseCodes, error) {
+func getCourseCodesFromDB(pool DB, courseIDs []string) ([]*CourseCodes, error) {
 
 	// perform query to retrieve course codes for specified courses and term
 	rows, err := pool.Query(context.Background(), `
@@ -71,7 +104,54 @@ func getCourseCodesFromDB(pool *pgxpool.Pool, courseIDs []string) ([]*CourseCode
 	return queryResults, nil
 }
 
-func updateSeatInfoDB(pool *pgxpool.Pool, coursesSeatInfo []*Course) error {
+// previous values of a section, read before it's upserted
+type oldSection struct {
+	term              int
+	capacity          int
+	openSeats         int
+	waitlistOpenSpots int
+}
+
+// getOldSections Reads current values of every section of given courses, so a batch's changes can
+// be found without querying each section.
+// Returns sections keyed by "<course id>-<section num>" or error if query fails
+func getOldSections(pool DB, courseIDs []string) (map[string]oldSection, error) {
+
+	rows, err := pool.Query(context.Background(), `
+		SELECT course_id, section_num, COALESCE(term, 0), COALESCE(capacity, 0), COALESCE(open_seats, 0),
+		       COALESCE(waitlist_open_spots, 0)
+		FROM course_sections
+		WHERE course_id = ANY($1);
+	`, courseIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Error with old section query: %w", err)
+	}
+	defer rows.Close()
+
+	sections := make(map[string]oldSection)
+	for rows.Next() {
+		var courseID, sectionNum string
+		var section oldSection
+		if err := rows.Scan(&courseID, &sectionNum, &section.term, &section.capacity, &section.openSeats,
+			&section.waitlistOpenSpots); err != nil {
+				return nil, fmt.Errorf("Error with old section row scan: %w", err)
+		}
+		sections[fmt.Sprintf("%s-%s", courseID, sectionNum)] = section
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with old section iteration: %w", rows.Err())
+	}
+
+	return sections, nil
+}
+
+// updateSeatInfoDB Upserts scraped section info into course_sections table. If diff is given,
+// sections that are new to the term, had their capacity raised or had their seat counts change are
+// added to it, comparing against the batch's sections as they were read before the upsert. A row
+// left over from another term counts as a new section.
+// Returns error on failure
+func updateSeatInfoDB(pool DB, coursesSeatInfo []*Course, diff *ScrapeDiff) error {
 
 	query := `
 		INSERT INTO course_sections (
@@ -95,13 +175,54 @@ func updateSeatInfoDB(pool *pgxpool.Pool, coursesSeatInfo []*Course) error {
 			last_updated        = CURRENT_TIMESTAMP;
 	`
 
+	packageQuery := `
+		INSERT INTO course_packages (term, course_id, package_key, section_nums, last_updated)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		ON CONFLICT (term, course_id, package_key)
+		DO UPDATE SET section_nums = EXCLUDED.section_nums, last_updated = CURRENT_TIMESTAMP;
+	`
+
+	// read the batch's sections before they're changed, only needed to build the diff
+	var oldSections map[string]oldSection
+	if diff != nil {
+		var courseIDs []string
+		for _, course := range coursesSeatInfo {
+			for _, enrollmentPackage := range course.EnrollmentPackages {
+				for _, section := range enrollmentPackage.Sections {
+					courseIDs = append(courseIDs, section.CourseID)
+				}
+			}
+		}
+
+		var err error
+		if oldSections, err = getOldSections(pool, courseIDs); err != nil {
+			return err
+		}
+	}
+
 	// create map to detect duplicates from scraper
 	var key string
 	inserted := make(map[string]bool)
-	
 
 	for _, course := range coursesSeatInfo {
+		var courseID string
+		var packageKeys []string
+
 		for _, enrollmentPackage := range course.EnrollmentPackages {
+
+			// record which sections make up the package
+			if len(enrollmentPackage.Sections) > 0 {
+				courseID = enrollmentPackage.Sections[0].CourseID
+				sectionNums := enrollmentPackage.sectionNums()
+				packageKey := strings.Join(sectionNums, "-")
+
+				_, err := pool.Exec(context.Background(), packageQuery, TermNum, courseID, packageKey, sectionNums)
+				if err != nil {
+					return fmt.Errorf("Failed to insert package %s course %s: %w", packageKey, courseID, err)
+				}
+				packageKeys = append(packageKeys, packageKey)
+			}
+
 			for _, section := range enrollmentPackage.Sections {	
 				
 				// skip already inserted duplicates to avoid redundancy
@@ -110,15 +231,17 @@ func updateSeatInfoDB(pool *pgxpool.Pool, coursesSeatInfo []*Course) error {
 					continue
 				}
 
+				courseName := fmt.Sprintf("%s %s", section.Subject.ShortDesc, section.CatalogNumber)
+				profName := fmt.Sprintf("%s %s", section.Professor.Name.First, section.Professor.Name.Last)
+
 				// insert section info into database
 				_, err := pool.Exec(context.Background(), query,
 
 					TermNum, section.CourseID, section.SectionNumber, section.ClassType, section.Subject.SubjectID,
-				  fmt.Sprintf("%s %s", section.Subject.ShortDesc, section.CatalogNumber), 
-				  course.CourseTitle, section.EnrollmentStatus.Capacity, 
+				  courseName, course.CourseTitle, section.EnrollmentStatus.Capacity,
 					section.EnrollmentStatus.CurrentlyEnrolled, section.EnrollmentStatus.OpenSeats, 
 					section.EnrollmentStatus.WaitlistCapacity, section.EnrollmentStatus.WaitlistOpenSpots,
-					fmt.Sprintf("%s %s", section.Professor.Name.First, section.Professor.Name.Last),
+					profName,
 				)
 
 				if err != nil {
@@ -127,6 +250,58 @@ func updateSeatInfoDB(pool *pgxpool.Pool, coursesSeatInfo []*Course) error {
 				}
 
 				inserted[key] = true
+				if diff == nil {
+					continue
+				}
+
+				diff.Upserted++
+
+				// sections kept from an earlier term are new to this one
+				old, existed := oldSections[key]
+				isNew := !existed || old.term != TermNum
+
+				openSeats := section.EnrollmentStatus.OpenSeats
+				waitlistOpenSpots := section.EnrollmentStatus.WaitlistOpenSpots
+				if !isNew && (old.openSeats != openSeats || old.waitlistOpenSpots != waitlistOpenSpots) {
+					diff.Changes = append(diff.Changes, SectionChange{
+						CourseID:             section.CourseID,
+						CourseName:           courseName,
+						SectionNum:           section.SectionNumber,
+						OldOpenSeats:         old.openSeats,
+						OpenSeats:            openSeats,
+						OldWaitlistOpenSpots: old.waitlistOpenSpots,
+						WaitlistOpenSpots:    waitlistOpenSpots,
+					})
+				}
+
+				capacityRaised := !isNew && section.EnrollmentStatus.Capacity > old.capacity
+				if isNew || capacityRaised {
+					newSection := NewSection{
+						CourseID:       section.CourseID,
+						CourseName:     courseName,
+						SectionNum:     section.SectionNumber,
+						SectionType:    section.ClassType,
+						Capacity:       section.EnrollmentStatus.Capacity,
+						OpenSeats:      section.EnrollmentStatus.OpenSeats,
+						ProfName:       profName,
+						CapacityRaised: capacityRaised,
+					}
+					if capacityRaised {
+						newSection.OldCapacity = old.capacity
+					}
+					diff.NewSections = append(diff.NewSections, newSection)
+				}
+			}
+		}
+
+		// remove packages that are no longer offered
+		if courseID != "" {
+			_, err := pool.Exec(context.Background(), `
+				DELETE FROM course_packages
+				WHERE term = $1 AND course_id = $2 AND NOT (package_key = ANY($3));
+			`, TermNum, courseID, packageKeys)
+			if err != nil {
+				return fmt.Errorf("Failed to remove old packages for course %s: %w", courseID, err)
 			}
 		}
 	}
@@ -137,13 +312,18 @@ func updateSeatInfoDB(pool *pgxpool.Pool, coursesSeatInfo []*Course) error {
 // CourseInfoUpdateDriver Retrieves course/subject ID from Postgres database and uses info to scrape
 // course seat info from UW Madison enrollment API. Uses scraped data to update Postgres database for
 // specified courses
-// Returns error on failure
-func CourseInfoUpdateDriver(pool *pgxpool.Pool, courseNames []string, batchSize int) error {
+// Returns changes detected during the update or error on failure
+func CourseInfoUpdateDriver(pool DB, courseNames []string, batchSize int) (*ScrapeDiff, error) {
 
 	// get course codes from database for specified courses
 	courseCodes, err := getCourseCodesFromDB(pool, courseNames)
 	if err != nil {
-		return fmt.Errorf("Error with retrieving course info from database: %w", err)
+		return nil, fmt.Errorf("Error with retrieving course info from database: %w", err)
+	}
+
+	diff := new(ScrapeDiff)
+	if err := pool.QueryRow(context.Background(), `SELECT CURRENT_TIMESTAMP`).Scan(&diff.StartedAt); err != nil {
+		return nil, fmt.Errorf("Error getting scrape start time: %w", err)
 	}
 
 	// batch course IDs
@@ -156,9 +336,8 @@ func CourseInfoUpdateDriver(pool *pgxpool.Pool, courseNames []string, batchSize
 
 		coursesSeatInfo := courseInfoScrape(pool, courseIDBatch)
 
-		err = updateSeatInfoDB(pool, coursesSeatInfo)
-		if err != nil {
-			return fmt.Errorf ("Failed to update DB with course info: %w", err)
+		if err := updateSeatInfoDB(pool, coursesSeatInfo, diff); err != nil {
+			return nil, fmt.Errorf ("Failed to update DB with course info: %w", err)
 		}
 
 		// delay next batch
@@ -167,7 +346,7 @@ func CourseInfoUpdateDriver(pool *pgxpool.Pool, courseNames []string, batchSize
 		}
 	}
 
-	log.Println("Uploaded seat info to DB")
+	log.Printf("Uploaded seat info to DB (%d new or raised capacity sections)", len(diff.NewSections))
 
-	return nil
+	return diff, nil
 }
@@ -0,0 +1,156 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// alert that would have been sent in a dry run
+type DryRunAlert struct {
+	Email             string
+	CourseName        string
+	SectionNum        string
+	AlertType         string
+	OpenSeats         int
+	WaitlistOpenSpots int
+	AlertKept         bool
+}
+
+// what a scrape and alert matching would have done
+type DryRunReport struct {
+	Diff   *ScrapeDiff
+	Alerts []DryRunAlert
+}
+
+// DryRunDriver Scrapes seat info for given courses and matches alerts against it like a normal
+// run, but inside a transaction that's always rolled back so nothing is written and nothing is
+// sent. The scrape itself runs before the transaction starts so rows are only locked briefly.
+// The transaction still locks the sections and alerts it would change (FOR UPDATE) until it's
+// rolled back, so a real run at the same time waits for it, and the outbox and other ID sequences
+// still advance since sequences aren't rolled back.
+// Returns report of what the run would have done or error on failure
+func DryRunDriver(ctx context.Context, pool *pgxpool.Pool, courseNames []string, batchSize int) (*DryRunReport, error) {
+
+	courseCodes, err := getCourseCodesFromDB(pool, courseNames)
+	if err != nil {
+		return nil, fmt.Errorf("Error with retrieving course info from database: %w", err)
+	}
+
+	// scrape every batch without touching the DB
+	const delay = 5 * time.Second
+	var courses []*Course
+	batches := batchCourseIDs(courseCodes, batchSize)
+	for i, courseIDBatch := range batches {
+		courses = append(courses, courseInfoScrape(nil, courseIDBatch)...)
+
+		if i < len(batches) - 1 {
+			time.Sleep(delay)
+		}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting dry run transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	report := &DryRunReport{Diff: new(ScrapeDiff)}
+	if err := tx.QueryRow(ctx, `SELECT CURRENT_TIMESTAMP`).Scan(&report.Diff.StartedAt); err != nil {
+		return nil, fmt.Errorf("Error getting scrape start time: %w", err)
+	}
+	if err := updateSeatInfoDB(tx, courses, report.Diff); err != nil {
+		return nil, fmt.Errorf("Failed to update DB with course info: %w", err)
+	}
+
+	// anything queued after this is from the dry run
+	var lastID int64
+	if err := tx.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM notification_outbox`).Scan(&lastID); err != nil {
+		return nil, fmt.Errorf("Error with outbox query: %w", err)
+	}
+
+	if _, _, err := ExpireAlerts(ctx, tx, TermNum); err != nil {
+		return nil, err
+	}
+	if err := QueueNewSectionAlerts(ctx, tx, TermNum, report.Diff.NewSections); err != nil {
+		return nil, err
+	}
+	if _, err := enqueueMatchedAlerts(ctx, tx, TermNum, report.Diff.StartedAt); err != nil {
+		return nil, err
+	}
+	if _, err := queuePackageAlerts(ctx, tx, TermNum); err != nil {
+		return nil, err
+	}
+	if _, err := queueSearchAlerts(ctx, tx, TermNum); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT email, course_name, section_num, alert_type, open_seats, waitlist_open_spots, alert_kept
+		FROM notification_outbox
+		WHERE id > $1
+		ORDER BY id;
+	`, lastID)
+	if err != nil {
+		return nil, fmt.Errorf("Error with dry run alert query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alert DryRunAlert
+		if err := rows.Scan(&alert.Email, &alert.CourseName, &alert.SectionNum, &alert.AlertType,
+			&alert.OpenSeats, &alert.WaitlistOpenSpots, &alert.AlertKept); err != nil {
+				return nil, fmt.Errorf("Error with dry run alert row scan: %w", err)
+		}
+		report.Alerts = append(report.Alerts, alert)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with dry run alert iteration: %w", rows.Err())
+	}
+
+	log.Printf("Dry run: %d sections upserted, %d new, %d changed, %d alerts matched",
+		report.Diff.Upserted, len(report.Diff.NewSections), len(report.Diff.Changes), len(report.Alerts))
+
+	return report, nil
+}
+
+// Print Writes report as tables of new sections, changed sections and alerts
+func (report *DryRunReport) Print(out io.Writer) {
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "DRY RUN: nothing was written to the database and no alerts were sent\n\n")
+	fmt.Fprintf(w, "Sections that would be upserted: %d\n\n", report.Diff.Upserted)
+
+	fmt.Fprintf(w, "New and raised capacity sections (%d)\n", len(report.Diff.NewSections))
+	fmt.Fprintln(w, "COURSE\tSECTION\tTYPE\tOPEN/CAPACITY\tINSTRUCTOR\tCHANGE")
+	for _, section := range report.Diff.NewSections {
+		change := "added"
+		if section.CapacityRaised {
+			change = fmt.Sprintf("capacity raised from %d", section.OldCapacity)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", section.CourseName, section.SectionNum, section.SectionType,
+			section.OpenSeats, section.Capacity, section.ProfName, change)
+	}
+
+	fmt.Fprintf(w, "\nChanged sections (%d)\n", len(report.Diff.Changes))
+	fmt.Fprintln(w, "COURSE\tSECTION\tOPEN SEATS\tWAITLIST OPEN")
+	for _, change := range report.Diff.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%d -> %d\t%d -> %d\n", change.CourseName, change.SectionNum,
+			change.OldOpenSeats, change.OpenSeats, change.OldWaitlistOpenSpots, change.WaitlistOpenSpots)
+	}
+
+	fmt.Fprintf(w, "\nAlerts that would fire (%d)\n", len(report.Alerts))
+	fmt.Fprintln(w, "RECIPIENT\tCOURSE\tSECTION\tTYPE\tOPEN SEATS\tWAITLIST OPEN\tKEPT")
+	for _, alert := range report.Alerts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%t\n", alert.Email, alert.CourseName, alert.SectionNum,
+			alert.AlertType, alert.OpenSeats, alert.WaitlistOpenSpots, alert.AlertKept)
+	}
+
+	w.Flush()
+}
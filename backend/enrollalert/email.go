@@ -3,45 +3,291 @@ package enrollalert
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
 	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 )
 
+// send rate used if the account's SES send quota can't be looked up (SES sandbox rate)
+const defaultSESSendRate = 1.0
+
+// names of SES stored templates used for each kind of email, emails are rendered from the
+// embedded templates instead when a name is empty
+type EmailTemplates struct {
+	SeatAlert  string
+	NewSection string
+	Digest     string
+	Expired    string
+	Search     string
+}
+
+// extra header added to an email
+type emailHeader struct {
+	name  string
+	value string
+}
+
+// emailSender is a backend (SES, SMTP) that delivers alert emails
+type emailSender interface {
+
+	// send Sends given kind of email to address with template data and extra headers.
+	// Returns provider message ID or error if email fails to send
+	send(ctx context.Context, to string, kind string, data map[string]interface{}, headers []emailHeader) (string, error)
+}
+
 type EmailClient struct {
-	svc  *sesv2.Client
-	from string
-	alertTemplate string
+	sender emailSender
+
+	// adds unsubscribe links and headers to emails if set
+	unsubscribe *UnsubscribeLinks
 }
 
-// cretes SES email client
-func NewEmailClient(ctx context.Context, from string, alertTemplate string) (*EmailClient, error) {
+// cretes SES email client, unsubscribe links are left out of emails if unsubscribe is nil
+func NewEmailClient(ctx context.Context, from string, templates EmailTemplates, unsubscribe *UnsubscribeLinks) (*EmailClient, error) {
 
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return &EmailClient{svc: sesv2.NewFromConfig(cfg), from: from, alertTemplate: alertTemplate,}, nil
+	svc := sesv2.NewFromConfig(cfg)
+
+	// keep sends under the account's maximum send rate
+	sendRate := defaultSESSendRate
+	if account, err := svc.GetAccount(ctx, &sesv2.GetAccountInput{}); err != nil {
+		log.Printf("Error getting SES send quota, sending at %.0f/s: %v", sendRate, err)
+	} else if account.SendQuota != nil && account.SendQuota.MaxSendRate > 0 {
+		sendRate = account.SendQuota.MaxSendRate
+	}
+
+	sender := &sesSender{
+		svc:  svc,
+		from: from,
+		storedTemplates: map[string]string{
+			seatAlertEmail:  templates.SeatAlert,
+			newSectionEmail: templates.NewSection,
+			digestEmail:     templates.Digest,
+			expiredEmail:    templates.Expired,
+			searchEmail:     templates.Search,
+		},
+		limiter: newSendLimiter(sendRate),
+	}
+
+	return &EmailClient{sender: sender, unsubscribe: unsubscribe,}, nil
 }
 
-// sends alert email to user using SES client
-func (c *EmailClient) SendSeatAlert(to string, data map[string]interface{}) error {
-	
-	payload, _ := json.Marshal(data)
+// creates email client that sends locally rendered emails through an SMTP server (e.g. MailHog
+// during development), authenticating only if username is set
+func NewSMTPEmailClient(from string, addr string, username string, password string, unsubscribe *UnsubscribeLinks) *EmailClient {
+	sender := &smtpSender{addr: addr, from: from, username: username, password: password}
+	return &EmailClient{sender: sender, unsubscribe: unsubscribe}
+}
 
-	_, err := c.svc.SendEmail(context.TODO(), &sesv2.SendEmailInput{
-		FromEmailAddress: aws.String(c.from),
-		Destination:      &sestypes.Destination{ToAddresses: []string{to}},
-		Content: &sestypes.EmailContent{
-			Template: &sestypes.Template{
-				TemplateName: aws.String(c.alertTemplate),
-				TemplateData: aws.String(string(payload)),
+// unsubscribeLinks Adds unsubscribe links to template data, with a link to cancel the alert
+// itself if it was kept.
+// Returns List-Unsubscribe headers (RFC 2369 and RFC 8058) for the email, nil if disabled
+func (c *EmailClient) unsubscribeLinks(userID int, alertID int64, data map[string]interface{}) []emailHeader {
+
+	if c.unsubscribe == nil {
+		return nil
+	}
+
+	userURL := c.unsubscribe.UserURL(userID)
+	data["unsubscribe_url"] = userURL
+	if alertID != 0 {
+		data["unsubscribe_alert_url"] = c.unsubscribe.AlertURL(userID, alertID)
+	}
+
+	// one-click unsubscribe from the mail client stops all alert emails
+	return []emailHeader{
+		{name: "List-Unsubscribe", value: "<" + userURL + ">"},
+		{name: "List-Unsubscribe-Post", value: "List-Unsubscribe=One-Click"},
+	}
+}
+
+// Channel Returns name of email notification channel
+func (c *EmailClient) Channel() string {
+	return "email"
+}
+
+// newSectionData Returns template data for a new section email
+func newSectionData(alert *SeatAlert) map[string]interface{} {
+	return map[string]interface{}{
+		"course_name":     alert.CourseName,
+		"course_id":       alert.CourseID,
+		"section_num":     alert.SectionNum,
+		"section_type":    alert.SectionType,
+		"prof_name":       alert.ProfName,
+		"open_seats":      alert.OpenSeats,
+		"capacity":        alert.Capacity,
+		"capacity_raised": alert.CapacityRaised,
+		"old_capacity":    alert.OldCapacity,
+	}
+}
+
+// seatAlertData Returns template data for a seat alert email
+func seatAlertData(alert *SeatAlert) map[string]interface{} {
+
+	// alerts in the same group that were cleared, left out if there are none so templates skip them
+	var cleared []map[string]interface{}
+	for _, name := range alert.ClearedAlternatives {
+		cleared = append(cleared, map[string]interface{}{"name": name})
+	}
+
+	return map[string]interface{}{
+		"course_name": alert.CourseName,
+		"section_num": alert.SectionNum,
+		"open_seats":  alert.OpenSeats,
+		"course_id":   alert.CourseID,
+		"alert_kept":  alert.AlertKept,
+		"waitlist":    alert.isWaitlist(),
+		"package":     alert.isPackage(),
+		"expression":  alert.Expression,
+		"cleared_alternatives": cleared,
+		"alternatives_action":  alert.alternativesAction(),
+		"waitlist_open_spots": alert.WaitlistOpenSpots,
+	}
+}
+
+// expiredData Returns template data for an email saying an alert expired without going off
+func expiredData(alert *SeatAlert) map[string]interface{} {
+	return map[string]interface{}{
+		"course_name": alert.CourseName,
+		"course_id":   alert.CourseID,
+		"section_num": alert.SectionNum,
+	}
+}
+
+// searchData Returns template data for an email listing the open sections matching a saved search
+func searchData(alert *SeatAlert) map[string]interface{} {
+
+	var results []map[string]interface{}
+	for _, result := range alert.SearchResults {
+		results = append(results, map[string]interface{}{
+			"course_name":  result.CourseName,
+			"section_num":  result.SectionNum,
+			"section_type": result.SectionType,
+			"prof_name":    result.ProfName,
+			"open_seats":   result.OpenSeats,
+			"capacity":     result.Capacity,
+		})
+	}
+
+	return map[string]interface{}{
+		"result_count": len(alert.SearchResults),
+		"results":      results,
+	}
+}
+
+// alertEmail Returns kind of email, template data and ID of the alert that can be cancelled
+// from the email (0 for none) for an alert
+func alertEmail(alert *SeatAlert) (string, map[string]interface{}, int64) {
+	switch {
+	case alert.isNewSection():
+		return newSectionEmail, newSectionData(alert), 0
+	case alert.isExpired():
+		return expiredEmail, expiredData(alert), 0
+	case alert.isSearch():
+		return searchEmail, searchData(alert), 0
+	}
+	return seatAlertEmail, seatAlertData(alert), alert.AlertID
+}
+
+// digestData Returns template data for a digest email listing every given alert
+func digestData(alerts []*SeatAlert) map[string]interface{} {
+
+	var items []map[string]interface{}
+	for _, alert := range alerts {
+		items = append(items, map[string]interface{}{
+			"course_name": alert.CourseName,
+			"section_num": alert.SectionNum,
+			"title":       alert.title(),
+			"summary":     alert.summary(),
+		})
+	}
+
+	return map[string]interface{}{
+		"alert_count": len(alerts),
+		"alerts":      items,
+	}
+}
+
+// Notify Sends seat alert, new section, expired alert or saved search email to the alert's email address.
+// Returns provider message ID or error if email fails to send
+func (c *EmailClient) Notify(ctx context.Context, userID int, alert *SeatAlert) (string, error) {
+	kind, data, alertID := alertEmail(alert)
+	headers := c.unsubscribeLinks(userID, alertID, data)
+	return c.sender.send(ctx, alert.Email, kind, data, headers)
+}
+
+// NotifyBatch Sends one digest email listing every one of the user's alerts.
+// Returns provider message ID or error if email fails to send
+func (c *EmailClient) NotifyBatch(ctx context.Context, userID int, alerts []*SeatAlert) (string, error) {
+	data := digestData(alerts)
+	headers := c.unsubscribeLinks(userID, 0, data)
+	return c.sender.send(ctx, alerts[0].Email, digestEmail, data, headers)
+}
+
+// sends emails through SES, using stored templates where configured
+type sesSender struct {
+	svc             *sesv2.Client
+	from            string
+	storedTemplates map[string]string
+	limiter         *sendLimiter
+}
+
+// sesHeaders Returns headers as SES message headers
+func sesHeaders(headers []emailHeader) []sestypes.MessageHeader {
+	var converted []sestypes.MessageHeader
+	for _, header := range headers {
+		converted = append(converted, sestypes.MessageHeader{Name: aws.String(header.name), Value: aws.String(header.value)})
+	}
+	return converted
+}
+
+// send Sends email using the kind's SES stored template, or as a locally rendered email if it
+// has no stored template.
+// Returns SES message ID or error if email fails to send
+func (s *sesSender) send(ctx context.Context, to string, kind string, data map[string]interface{},
+	headers []emailHeader) (string, error) {
+
+	content := &sestypes.EmailContent{}
+	if template := s.storedTemplates[kind]; template != "" {
+		payload, _ := json.Marshal(data)
+		content.Template = &sestypes.Template{
+			TemplateName: aws.String(template),
+			TemplateData: aws.String(string(payload)),
+			Headers:      sesHeaders(headers),
+		}
+	} else {
+		email, err := renderEmail(kind, data)
+		if err != nil {
+			return "", err
+		}
+		content.Simple = &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String(email.Subject), Charset: aws.String("UTF-8")},
+			Body: &sestypes.Body{
+				Html: &sestypes.Content{Data: aws.String(email.Html), Charset: aws.String("UTF-8")},
+				Text: &sestypes.Content{Data: aws.String(email.Text), Charset: aws.String("UTF-8")},
 			},
-		},
+			Headers: sesHeaders(headers),
+		}
+	}
+
+	if err := s.limiter.wait(ctx, 1); err != nil {
+		return "", err
+	}
+
+	out, err := s.svc.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(s.from),
+		Destination:      &sestypes.Destination{ToAddresses: []string{to}},
+		Content:          content,
 	})
+	if err != nil {
+		return "", err
+	}
 
-	return err
+	return aws.ToString(out.MessageId), nil
 }
-
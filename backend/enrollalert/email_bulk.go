@@ -0,0 +1,126 @@
+package enrollalert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// most destinations SES accepts in one bulk send
+const sesBulkMaxEntries = 50
+
+// bulkNotifier is a notification channel that can send many users' alerts in one request
+type bulkNotifier interface {
+	Notifier
+
+	// notifyBulk Sends each alert to its user, alerts[i] going to userIDs[i].
+	// Returns result for each alert it sent keyed by index, alerts it can't bulk send are left out
+	notifyBulk(ctx context.Context, userIDs []int, alerts []*SeatAlert) map[int]deliveryResult
+}
+
+// one email in a bulk send
+type bulkEmail struct {
+	to      string
+	data    map[string]interface{}
+	headers []emailHeader
+}
+
+// notifyBulk Sends alert emails that use an SES stored template in bulk, one request per kind of
+// email per 50 alerts. Other alerts are left to be sent one at a time.
+// Returns result for each alert sent keyed by index
+func (c *EmailClient) notifyBulk(ctx context.Context, userIDs []int, alerts []*SeatAlert) map[int]deliveryResult {
+
+	results := make(map[int]deliveryResult)
+
+	ses, ok := c.sender.(*sesSender)
+	if !ok {
+		return results
+	}
+
+	// group alerts by kind of email, keeping track of where each came from
+	indexes := make(map[string][]int)
+	emails := make(map[string][]bulkEmail)
+	for i, alert := range alerts {
+		kind, data, alertID := alertEmail(alert)
+		if ses.storedTemplates[kind] == "" {
+			continue
+		}
+
+		headers := c.unsubscribeLinks(userIDs[i], alertID, data)
+		indexes[kind] = append(indexes[kind], i)
+		emails[kind] = append(emails[kind], bulkEmail{to: alert.Email, data: data, headers: headers})
+	}
+
+	for kind, kindEmails := range emails {
+		for start := 0; start < len(kindEmails); start += sesBulkMaxEntries {
+			end := min(start+sesBulkMaxEntries, len(kindEmails))
+
+			chunkResults := ses.sendBulk(ctx, kind, kindEmails[start:end])
+			for offset, result := range chunkResults {
+				results[indexes[kind][start+offset]] = result
+			}
+		}
+	}
+
+	return results
+}
+
+// sendBulk Sends emails of one kind with a single SES bulk templated send.
+// Returns result for each email, in order
+func (s *sesSender) sendBulk(ctx context.Context, kind string, emails []bulkEmail) []deliveryResult {
+
+	results := make([]deliveryResult, len(emails))
+	fail := func(err error) []deliveryResult {
+		for i := range results {
+			results[i].err = err
+		}
+		return results
+	}
+
+	var entries []sestypes.BulkEmailEntry
+	for _, email := range emails {
+		payload, _ := json.Marshal(email.data)
+		entries = append(entries, sestypes.BulkEmailEntry{
+			Destination: &sestypes.Destination{ToAddresses: []string{email.to}},
+			ReplacementEmailContent: &sestypes.ReplacementEmailContent{
+				ReplacementTemplate: &sestypes.ReplacementTemplate{ReplacementTemplateData: aws.String(string(payload))},
+			},
+			ReplacementHeaders: sesHeaders(email.headers),
+		})
+	}
+
+	if err := s.limiter.wait(ctx, len(emails)); err != nil {
+		return fail(err)
+	}
+
+	out, err := s.svc.SendBulkEmail(ctx, &sesv2.SendBulkEmailInput{
+		FromEmailAddress: aws.String(s.from),
+		DefaultContent: &sestypes.BulkEmailContent{
+			Template: &sestypes.Template{
+				TemplateName: aws.String(s.storedTemplates[kind]),
+				TemplateData: aws.String("{}"),
+			},
+		},
+		BulkEmailEntries: entries,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	if len(out.BulkEmailEntryResults) != len(emails) {
+		return fail(fmt.Errorf("SES bulk send returned %d results for %d emails", len(out.BulkEmailEntryResults), len(emails)))
+	}
+
+	for i, entry := range out.BulkEmailEntryResults {
+		if entry.Status != sestypes.BulkEmailStatusSuccess {
+			results[i].err = fmt.Errorf("SES bulk send %s: %s", entry.Status, aws.ToString(entry.Error))
+			continue
+		}
+		results[i].messageID = aws.ToString(entry.MessageId)
+	}
+
+	return results
+}
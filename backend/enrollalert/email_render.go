@@ -0,0 +1,171 @@
+package enrollalert
+
+import (
+	"bytes"
+	"encoding/json"
+	"enroll-alert/email_templates"
+	"fmt"
+	htmltemplate "html/template"
+	"regexp"
+	"sync"
+	texttemplate "text/template"
+)
+
+// kinds of emails, named after their body files in email_templates
+const (
+	seatAlertEmail  = "seat-alert"
+	newSectionEmail = "new-section"
+	digestEmail     = "alert-digest"
+	expiredEmail    = "alert-expired"
+	searchEmail     = "search-results"
+)
+
+// SES template file each kind of email takes its subject from
+var emailTemplateFiles = map[string]string{
+	seatAlertEmail:  "seat-template.json",
+	newSectionEmail: "new-section-template.json",
+	digestEmail:     "alert-digest-template.json",
+	expiredEmail:    "alert-expired-template.json",
+	searchEmail:     "search-results-template.json",
+}
+
+// matches the handlebars tags used in templates: {{name}}, {{#if name}}, {{else if name}},
+// {{else}}, {{/if}}, {{#each name}} and {{/each}}
+var handlebarsTag = regexp.MustCompile(`\{\{\s*(#if|#each|/if|/each|else if|else)?\s*([A-Za-z_][A-Za-z0-9_]*)?\s*\}\}`)
+
+// structure of SES stored template files
+type sesTemplateFile struct {
+	Subject string `json:"Subject"`
+	Html    string `json:"Html"`
+	Text    string `json:"Text"`
+}
+
+// RenderedEmail is an email rendered from the embedded templates
+type RenderedEmail struct {
+	Subject string
+	Html    string
+	Text    string
+}
+
+// parsed templates for one kind of email
+type localTemplate struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+var (
+	localTemplatesOnce sync.Once
+	localTemplates     map[string]*localTemplate
+	localTemplatesErr  error
+)
+
+// translateHandlebars Rewrites handlebars tags as Go template actions so the same files can be
+// used by SES and rendered locally. Values are looked up with lookup so missing ones render
+// empty and are falsy, as they are in SES.
+// Returns Go template source
+func translateHandlebars(source string) string {
+	return handlebarsTag.ReplaceAllStringFunc(source, func(tag string) string {
+		parts := handlebarsTag.FindStringSubmatch(tag)
+		block, name := parts[1], parts[2]
+
+		switch block {
+		case "#if":
+			return fmt.Sprintf(`{{if lookup . %q}}`, name)
+		case "else if":
+			return fmt.Sprintf(`{{else if lookup . %q}}`, name)
+		case "else":
+			return `{{else}}`
+		case "#each":
+			return fmt.Sprintf(`{{range lookup . %q}}`, name)
+		case "/if", "/each":
+			return `{{end}}`
+		}
+		return fmt.Sprintf(`{{lookup . %q}}`, name)
+	})
+}
+
+// lookup Returns value of key in template data, or empty string if data has no such key
+func lookup(data interface{}, key string) interface{} {
+	if values, ok := data.(map[string]interface{}); ok && values[key] != nil {
+		return values[key]
+	}
+	return ""
+}
+
+// loadLocalTemplates Parses every embedded email template.
+// Returns templates keyed by kind of email or error if any template is missing or invalid
+func loadLocalTemplates() (map[string]*localTemplate, error) {
+
+	funcs := map[string]interface{}{"lookup": lookup}
+
+	templates := make(map[string]*localTemplate)
+	for kind, jsonFile := range emailTemplateFiles {
+
+		raw, err := emailtemplates.Files.ReadFile(jsonFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %w", jsonFile, err)
+		}
+		var stored sesTemplateFile
+		if err := json.Unmarshal(raw, &stored); err != nil {
+			return nil, fmt.Errorf("Error with %s unmarshal: %w", jsonFile, err)
+		}
+
+		htmlSource, err := emailtemplates.Files.ReadFile(kind + ".html")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s.html: %w", kind, err)
+		}
+		textSource, err := emailtemplates.Files.ReadFile(kind + ".txt")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s.txt: %w", kind, err)
+		}
+
+		tmpl := new(localTemplate)
+		if tmpl.subject, err = texttemplate.New(kind + " subject").Funcs(funcs).
+			Parse(translateHandlebars(stored.Subject)); err != nil {
+				return nil, fmt.Errorf("Error parsing %s subject: %w", kind, err)
+		}
+		if tmpl.html, err = htmltemplate.New(kind + ".html").Funcs(funcs).
+			Parse(translateHandlebars(string(htmlSource))); err != nil {
+				return nil, fmt.Errorf("Error parsing %s.html: %w", kind, err)
+		}
+		if tmpl.text, err = texttemplate.New(kind + ".txt").Funcs(funcs).
+			Parse(translateHandlebars(string(textSource))); err != nil {
+				return nil, fmt.Errorf("Error parsing %s.txt: %w", kind, err)
+		}
+
+		templates[kind] = tmpl
+	}
+
+	return templates, nil
+}
+
+// renderEmail Renders subject, HTML and text bodies of given kind of email with template data.
+// Returns rendered email or error if templates can't be loaded or rendered
+func renderEmail(kind string, data map[string]interface{}) (*RenderedEmail, error) {
+
+	localTemplatesOnce.Do(func() {
+		localTemplates, localTemplatesErr = loadLocalTemplates()
+	})
+	if localTemplatesErr != nil {
+		return nil, localTemplatesErr
+	}
+
+	tmpl, ok := localTemplates[kind]
+	if !ok {
+		return nil, fmt.Errorf("No email template for %q", kind)
+	}
+
+	var subject, html, text bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("Error rendering %s subject: %w", kind, err)
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("Error rendering %s.html: %w", kind, err)
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("Error rendering %s.txt: %w", kind, err)
+	}
+
+	return &RenderedEmail{Subject: subject.String(), Html: html.String(), Text: text.String()}, nil
+}
@@ -0,0 +1,112 @@
+package enrollalert
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// sends locally rendered emails through an SMTP server
+type smtpSender struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+// buildMessage Builds multipart/alternative MIME message with text and HTML bodies.
+// Returns raw message or error if it can't be written
+func (s *smtpSender) buildMessage(to string, messageID string, email *RenderedEmail, headers []emailHeader) ([]byte, error) {
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", email.Text},
+		{"text/html; charset=UTF-8", email.Html},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", email.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s>\r\n", messageID)
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header.name, header.value)
+	}
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
+
+// send Renders email from the embedded templates and sends it through the SMTP server.
+// Returns generated Message-ID or error if email fails to render or send
+func (s *smtpSender) send(ctx context.Context, to string, kind string, data map[string]interface{},
+	headers []emailHeader) (string, error) {
+
+	email, err := renderEmail(kind, data)
+	if err != nil {
+		return "", err
+	}
+
+	fromAddress, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return "", fmt.Errorf("Invalid from address %q: %w", s.from, err)
+	}
+
+	random := make([]byte, 12)
+	rand.Read(random)
+	messageID := hex.EncodeToString(random) + "@enrollalert"
+
+	message, err := s.buildMessage(to, messageID, email, headers)
+	if err != nil {
+		return "", fmt.Errorf("Error building %s email: %w", kind, err)
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+
+	if err := smtp.SendMail(s.addr, auth, fromAddress.Address, []string{to}, message); err != nil {
+		return "", fmt.Errorf("Error sending %s email over SMTP: %w", kind, err)
+	}
+
+	return messageID, nil
+}
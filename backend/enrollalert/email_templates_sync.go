@@ -0,0 +1,372 @@
+package enrollalert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"enroll-alert/email_templates"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// EmailSample is sample data for previewing one variant of an email
+type EmailSample struct {
+	Name string
+	Kind string
+	Data map[string]interface{}
+
+	alertID int64 // alert the email's cancel link is for, 0 for none
+}
+
+// keys each kind of email's template data has, with keys of list items as "<list>.<key>".
+// Templates may only use these, and the data builders must supply exactly these.
+var emailTemplateKeys = map[string][]string{
+	seatAlertEmail: {
+		"course_name", "course_id", "section_num", "open_seats", "alert_kept", "waitlist", "package",
+		"expression", "cleared_alternatives", "cleared_alternatives.name", "alternatives_action",
+		"waitlist_open_spots", "unsubscribe_url", "unsubscribe_alert_url",
+	},
+	newSectionEmail: {
+		"course_name", "course_id", "section_num", "section_type", "prof_name", "open_seats", "capacity",
+		"capacity_raised", "old_capacity", "unsubscribe_url",
+	},
+	digestEmail: {
+		"alert_count", "alerts", "alerts.course_name", "alerts.section_num", "alerts.title", "alerts.summary",
+		"unsubscribe_url",
+	},
+	expiredEmail: {"course_name", "course_id", "section_num", "unsubscribe_url"},
+	searchEmail: {
+		"result_count", "results", "results.course_name", "results.section_num", "results.section_type",
+		"results.prof_name", "results.open_seats", "results.capacity", "unsubscribe_url",
+	},
+}
+
+// keys added by unsubscribeLinks rather than the data builders, only set when links are enabled
+var unsubscribeKeys = []string{"unsubscribe_url", "unsubscribe_alert_url"}
+
+// EmailTemplateKinds Returns every kind of email, sorted
+func EmailTemplateKinds() []string {
+	var kinds []string
+	for kind := range emailTemplateFiles {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// withSampleLinks Adds unsubscribe links to sample data the same way emails get them.
+// Returns data
+func withSampleLinks(data map[string]interface{}, alertID int64) map[string]interface{} {
+	links := &UnsubscribeLinks{secret: []byte("preview"), baseURL: "https://enrollalert.com/unsubscribe"}
+	client := &EmailClient{unsubscribe: links}
+	client.unsubscribeLinks(1, alertID, data)
+	return data
+}
+
+// EmailSamples Builds sample data for each variant of every email, using the same data
+// builders and unsubscribe links as the emails that are sent.
+// Returns list of samples
+func EmailSamples() []EmailSample {
+
+	samples := emailSamples()
+	for _, sample := range samples {
+		withSampleLinks(sample.Data, sample.alertID)
+	}
+	return samples
+}
+
+// emailSamples Builds sample data for each variant of every email with only the data builders,
+// without unsubscribe links.
+// Returns list of samples
+func emailSamples() []EmailSample {
+
+	now := time.Now()
+	seat := &SeatAlert{
+		Email: "student@wisc.edu", Term: 1262, CourseID: "005698", CourseName: "COMP SCI 400",
+		SectionNum: "001", AlertType: "any", OpenSeats: 3, Timestamp: now,
+	}
+	waitlist := *seat
+	waitlist.AlertType, waitlist.OpenSeats, waitlist.WaitlistOpenSpots, waitlist.WaitlistCapacity = "waitlist", 0, 2, 10
+	kept := *seat
+	kept.AlertType, kept.AlertKept, kept.AlertID = "threshold", true, 42
+	grouped := *seat
+	grouped.ClearedAlternatives = []string{"COMP SCI 400 section 002", "COMP SCI 400 section 003"}
+	pkg := *seat
+	pkg.AlertType, pkg.SectionNum = "any_package", "LEC 001 + DIS 312"
+	expression := *seat
+	expression.AlertType, expression.Expression = "expression", `open_seats >= 2 && prof_name.contains("Smith")`
+	newSection := &SeatAlert{
+		Email: "student@wisc.edu", Term: 1262, CourseID: "005698", CourseName: "COMP SCI 400",
+		SectionNum: "004", SectionType: "LEC", ProfName: "Jane Doe", AlertType: "new_section",
+		OpenSeats: 120, Capacity: 120, Timestamp: now,
+	}
+	raised := *newSection
+	raised.SectionNum, raised.OpenSeats, raised.CapacityRaised, raised.OldCapacity = "001", 20, true, 150
+	raised.Capacity = 170
+	expired := *seat
+	expired.AlertType, expired.OpenSeats = "expired", 0
+	search := &SeatAlert{
+		Email: "student@wisc.edu", Term: 1262, CourseID: "005698", CourseName: "COMP SCI 400",
+		SectionNum: "001", SectionType: "LEC", ProfName: "Jane Doe", AlertType: "search",
+		OpenSeats: 12, Capacity: 150, Timestamp: now,
+		SearchResults: []SearchResult{
+			{CourseID: "005698", CourseName: "COMP SCI 400", SectionNum: "001", SectionType: "LEC",
+				ProfName: "Jane Doe", OpenSeats: 12, Capacity: 150},
+			{CourseID: "012345", CourseName: "COMP SCI 407", SectionNum: "002", SectionType: "LEC",
+				ProfName: "John Smith", OpenSeats: 3, Capacity: 80},
+		},
+	}
+
+	return []EmailSample{
+		{Name: "seat-alert", Kind: seatAlertEmail, Data: seatAlertData(seat)},
+		{Name: "seat-alert-kept", Kind: seatAlertEmail, Data: seatAlertData(&kept), alertID: kept.AlertID},
+		{Name: "seat-alert-waitlist", Kind: seatAlertEmail, Data: seatAlertData(&waitlist)},
+		{Name: "seat-alert-package", Kind: seatAlertEmail, Data: seatAlertData(&pkg)},
+		{Name: "seat-alert-grouped", Kind: seatAlertEmail, Data: seatAlertData(&grouped)},
+		{Name: "seat-alert-expression", Kind: seatAlertEmail, Data: seatAlertData(&expression)},
+		{Name: "new-section", Kind: newSectionEmail, Data: newSectionData(newSection)},
+		{Name: "new-section-capacity", Kind: newSectionEmail, Data: newSectionData(&raised)},
+		{Name: "alert-expired", Kind: expiredEmail, Data: expiredData(&expired)},
+		{Name: "search-results", Kind: searchEmail, Data: searchData(search)},
+		{Name: "alert-digest", Kind: digestEmail, Data: digestData([]*SeatAlert{seat, &waitlist, newSection, search})},
+	}
+}
+
+// RenderEmailSample Renders sample with the embedded templates.
+// Returns rendered email or error if rendering fails
+func RenderEmailSample(sample EmailSample) (*RenderedEmail, error) {
+	return renderEmail(sample.Kind, sample.Data)
+}
+
+// placeholder referenced by a template, scope is the list it's read from inside {{#each}}
+type placeholder struct {
+	name  string
+	scope string
+}
+
+// templatePlaceholders Finds every value referenced by a template, including ones only used in
+// conditions.
+// Returns list of placeholders
+func templatePlaceholders(source string) []placeholder {
+
+	var placeholders []placeholder
+	var scopes []string
+	for _, parts := range handlebarsTag.FindAllStringSubmatch(source, -1) {
+		block, name := parts[1], parts[2]
+
+		scope := ""
+		if len(scopes) > 0 {
+			scope = scopes[len(scopes)-1]
+		}
+
+		switch block {
+		case "#each":
+			placeholders = append(placeholders, placeholder{name: name, scope: scope})
+			scopes = append(scopes, name)
+		case "/each":
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+		case "else", "/if":
+		default:
+			placeholders = append(placeholders, placeholder{name: name, scope: scope})
+		}
+	}
+
+	return placeholders
+}
+
+// dataKeys Lists keys in template data, with keys of list items as "<list>.<key>".
+// Returns set of keys
+func dataKeys(data map[string]interface{}) map[string]bool {
+
+	keys := make(map[string]bool)
+	for key, value := range data {
+		keys[key] = true
+		if items, ok := value.([]map[string]interface{}); ok {
+			for _, item := range items {
+				for itemKey := range item {
+					keys[key+"."+itemKey] = true
+				}
+			}
+		}
+	}
+
+	return keys
+}
+
+// checkEmailData Checks the data builders' output for every variant of a kind of email against
+// its declared keys. Every variant must supply every declared key other than list item keys
+// (its lists may be empty) and unsubscribe links, and no variant may supply undeclared keys.
+// Returns list of problems found
+func checkEmailData(kind string) []string {
+
+	declared := emailTemplateKeys[kind]
+
+	var problems []string
+	var itemKeysSeen []string
+	for _, sample := range emailSamples() {
+		if sample.Kind != kind {
+			continue
+		}
+
+		keys := dataKeys(sample.Data)
+		for _, key := range declared {
+			if strings.Contains(key, ".") {
+				if keys[key] {
+					itemKeysSeen = append(itemKeysSeen, key)
+				}
+				continue
+			}
+			if !keys[key] && !slices.Contains(unsubscribeKeys, key) {
+				problems = append(problems, fmt.Sprintf("%s data is missing declared key %s", sample.Name, key))
+			}
+		}
+		for key := range keys {
+			if !slices.Contains(declared, key) {
+				problems = append(problems, fmt.Sprintf("%s data has undeclared key %s", sample.Name, key))
+			}
+		}
+	}
+
+	// list item keys only have to show up in a sample whose list isn't empty
+	for _, key := range declared {
+		if strings.Contains(key, ".") && !slices.Contains(itemKeysSeen, key) {
+			problems = append(problems, fmt.Sprintf("%s data never has declared key %s", kind, key))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// readSESTemplateFile Reads SES stored template file for given kind of email.
+// Returns template contents or error if file can't be read
+func readSESTemplateFile(kind string) (*sesTemplateFile, error) {
+
+	raw, err := emailtemplates.Files.ReadFile(emailTemplateFiles[kind])
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", emailTemplateFiles[kind], err)
+	}
+
+	var stored sesTemplateFile
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, fmt.Errorf("Error with %s unmarshal: %w", emailTemplateFiles[kind], err)
+	}
+
+	return &stored, nil
+}
+
+// CheckEmailTemplate Checks that every placeholder in a kind of email's templates is one of its
+// declared keys, that the Go data builders supply exactly those keys, and that its SES stored
+// template matches the .html and .txt files it's built from.
+// Returns list of problems found, or error if templates can't be read
+func CheckEmailTemplate(kind string) ([]string, error) {
+
+	stored, err := readSESTemplateFile(kind)
+	if err != nil {
+		return nil, err
+	}
+	htmlFile, err := emailtemplates.Files.ReadFile(kind + ".html")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s.html: %w", kind, err)
+	}
+	textFile, err := emailtemplates.Files.ReadFile(kind + ".txt")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s.txt: %w", kind, err)
+	}
+
+	sources := []struct {
+		name   string
+		source string
+	}{
+		{emailTemplateFiles[kind] + " Subject", stored.Subject},
+		{emailTemplateFiles[kind] + " Html", stored.Html},
+		{emailTemplateFiles[kind] + " Text", stored.Text},
+		{kind + ".html", string(htmlFile)},
+		{kind + ".txt", string(textFile)},
+	}
+
+	problems := checkEmailData(kind)
+	for _, source := range sources {
+		var missing []string
+		for _, ref := range templatePlaceholders(source.source) {
+			key := ref.name
+			if ref.scope != "" {
+				key = ref.scope + "." + ref.name
+			}
+			if !slices.Contains(emailTemplateKeys[kind], key) && !slices.Contains(missing, key) {
+				missing = append(missing, key)
+			}
+		}
+		for _, key := range missing {
+			problems = append(problems, fmt.Sprintf("%s: {{%s}} isn't a declared key of the Go template data", source.name, key))
+		}
+	}
+
+	// SES template is the files with whitespace collapsed
+	if whitespace.ReplaceAllString(stored.Html, "") != whitespace.ReplaceAllString(string(htmlFile), "") {
+		problems = append(problems, fmt.Sprintf("%s Html doesn't match %s.html", emailTemplateFiles[kind], kind))
+	}
+	if whitespace.ReplaceAllString(stored.Text, "") != whitespace.ReplaceAllString(string(textFile), "") {
+		problems = append(problems, fmt.Sprintf("%s Text doesn't match %s.txt", emailTemplateFiles[kind], kind))
+	}
+
+	return problems, nil
+}
+
+// SyncSESTemplate Creates SES stored template with given name from a kind of email's template
+// file, or updates it if its contents differ. Running it again with no changes does nothing.
+// Returns what was done ("created", "updated" or "unchanged") or error if SES request fails
+func SyncSESTemplate(ctx context.Context, svc *sesv2.Client, name string, kind string) (string, error) {
+
+	stored, err := readSESTemplateFile(kind)
+	if err != nil {
+		return "", err
+	}
+
+	content := &sestypes.EmailTemplateContent{
+		Subject: aws.String(stored.Subject),
+		Html:    aws.String(stored.Html),
+		Text:    aws.String(stored.Text),
+	}
+
+	existing, err := svc.GetEmailTemplate(ctx, &sesv2.GetEmailTemplateInput{TemplateName: aws.String(name)})
+
+	var notFound *sestypes.NotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		if _, err := svc.CreateEmailTemplate(ctx, &sesv2.CreateEmailTemplateInput{
+			TemplateName: aws.String(name), TemplateContent: content,
+		}); err != nil {
+			return "", fmt.Errorf("Error creating SES template %s: %w", name, err)
+		}
+		return "created", nil
+
+	case err != nil:
+		return "", fmt.Errorf("Error getting SES template %s: %w", name, err)
+	}
+
+	current := existing.TemplateContent
+	if current != nil && strings.TrimSpace(aws.ToString(current.Subject)) == strings.TrimSpace(stored.Subject) &&
+		aws.ToString(current.Html) == stored.Html && aws.ToString(current.Text) == stored.Text {
+			return "unchanged", nil
+	}
+
+	if _, err := svc.UpdateEmailTemplate(ctx, &sesv2.UpdateEmailTemplateInput{
+		TemplateName: aws.String(name), TemplateContent: content,
+	}); err != nil {
+		return "", fmt.Errorf("Error updating SES template %s: %w", name, err)
+	}
+
+	return "updated", nil
+}
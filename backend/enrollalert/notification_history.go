@@ -0,0 +1,154 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// kinds of batched sends an alert can be delivered in
+const (
+	digestBatch = "digest" // one message listing several of a user's alerts
+	bulkBatch   = "bulk"   // separate messages to several users in one request
+)
+
+// result of sending an alert through a channel
+type deliveryResult struct {
+	messageID string
+	err       error
+	batch     string // kind of batched send the alert was part of, empty if sent on its own
+}
+
+// single delivery attempt from the notifications table
+type NotificationRecord struct {
+	ID                int64
+	Channel           string
+	Recipient         string
+	Term              int
+	CourseID          string
+	CourseName        string
+	SectionNum        string
+	AlertType         string
+	MatchedOpenSeats  int
+	OpenSeats         *int
+	ProviderMessageID string
+	Status            string
+	Error             string
+	Attempt           int
+	Batched           bool
+	BatchKind         string // digest or bulk for batched deliveries, empty if unknown
+	CreatedAt         time.Time
+}
+
+// recordDelivery Saves delivery attempt of outbox entry through a channel into the notifications
+// table along with the section's seat info at the time of sending.
+// Returns error if insert fails
+func recordDelivery(ctx context.Context, pool *pgxpool.Pool, entry *outboxEntry, channel string,
+	result deliveryResult) error {
+
+	status := "sent"
+	var errMsg *string
+	if result.err != nil {
+		status = "failed"
+		msg := result.err.Error()
+		errMsg = &msg
+	}
+
+	var messageID *string
+	if result.messageID != "" {
+		messageID = &result.messageID
+	}
+
+	var batchKind *string
+	if result.batch != "" {
+		batchKind = &result.batch
+	}
+
+	// recipient is only known for email, other channels can have several targets
+	var recipient *string
+	if channel == "email" {
+		recipient = &entry.email
+	}
+
+	_, err := pool.Exec(ctx, `
+		INSERT INTO notifications (
+			outbox_id, user_id, recipient, channel, term, course_id, course_name, section_num,
+			alert_type, seat_threshold, matched_open_seats, open_seats, capacity,
+			waitlist_open_spots, waitlist_capacity, provider_message_id, status, error, attempt, batched,
+			batch_kind
+		)
+		SELECT nob.id, nob.user_id, $2, $3, nob.term, nob.course_id, nob.course_name, nob.section_num,
+		       nob.alert_type, nob.seat_threshold, nob.open_seats, cs.open_seats, cs.capacity,
+		       cs.waitlist_open_spots, cs.waitlist_capacity, $4, $5, $6, nob.attempts, $7 IS NOT NULL,
+		       $7
+		FROM notification_outbox nob
+		LEFT JOIN course_sections cs
+		       ON cs.course_id   = nob.course_id
+		      AND cs.section_num = nob.section_num
+		      AND cs.term        = nob.term
+		WHERE nob.id = $1;
+	`, entry.id, recipient, channel, messageID, status, errMsg, batchKind)
+
+	if err != nil {
+		return fmt.Errorf("Error recording %s delivery for outbox entry %d: %w", channel, entry.id, err)
+	}
+
+	return nil
+}
+
+// GetUserNotificationHistory Queries most recent delivery attempts for given user.
+// Returns list of delivery attempts, newest first, or error if query fails
+func GetUserNotificationHistory(ctx context.Context, pool *pgxpool.Pool, userID int, limit int) ([]NotificationRecord, error) {
+
+	rows, err := pool.Query(ctx, `
+		SELECT id, channel, COALESCE(recipient, ''), term, course_id, course_name, section_num,
+		       alert_type, matched_open_seats, open_seats, COALESCE(provider_message_id, ''),
+		       status, COALESCE(error, ''), attempt, batched, COALESCE(batch_kind, ''), created_at
+		FROM notifications
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2;
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Error with notification history query: %w", err)
+	}
+	defer rows.Close()
+
+	var records []NotificationRecord
+	for rows.Next() {
+		var record NotificationRecord
+		if err := rows.Scan(&record.ID, &record.Channel, &record.Recipient, &record.Term,
+			&record.CourseID, &record.CourseName, &record.SectionNum, &record.AlertType,
+			&record.MatchedOpenSeats, &record.OpenSeats, &record.ProviderMessageID, &record.Status,
+			&record.Error, &record.Attempt, &record.Batched, &record.BatchKind, &record.CreatedAt); err != nil {
+				return nil, fmt.Errorf("Error with notification row scan: %w", err)
+		}
+		records = append(records, record)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with notification iteration: %w", rows.Err())
+	}
+
+	return records, nil
+}
+
+// FindUserID Looks up user by ID, email or Firebase UID.
+// Returns user ID or error if no user matches
+func FindUserID(ctx context.Context, pool *pgxpool.Pool, search string) (int, error) {
+
+	var userID int
+	err := pool.QueryRow(ctx, `
+		SELECT id
+		FROM users
+		WHERE id::text = $1 OR lower(email) = lower($1) OR firebase_uid = $1
+		ORDER BY id
+		LIMIT 1;
+	`, search).Scan(&userID)
+	if err != nil {
+		return 0, fmt.Errorf("Error finding user %q: %w", search, err)
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,520 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	outboxBatchSize      = 100
+	outboxMaxAttempts    = 5
+	outboxWorkers        = 10
+	outboxInitialBackoff = 1 * time.Minute
+
+	// time a claimed entry is reserved for before another run can pick it back up
+	outboxLease = 5 * time.Minute
+)
+
+// queued alert waiting to be sent
+type outboxEntry struct {
+	id                int64
+	idempotencyKey    string
+	userID            int
+	email             string
+	term              int
+	courseID          string
+	courseName        string
+	sectionNum        string
+	sectionType       string
+	profName          string
+	alertType         string
+	seatThreshold     *int
+	expression        string
+	openSeats         int
+	capacity          int
+	capacityRaised    bool
+	oldCapacity       int
+	waitlistOpenSpots int
+	waitlistCapacity  int
+	alertKept         bool
+	alertID           int64
+	clearedAlternatives       []string
+	alternativesPausedMinutes int
+	groupID           int64 // group whose other alerts are held until this is sent, 0 for none
+	chatWebhookIDs    []int64
+	alertSnapshot     []byte // removed alert as it was before firing, nil if kept
+	searchResults     []SearchResult
+	channelsSent      []string
+	targetsSent       []string
+	digest            bool
+	emailStatus       string // bounced, complained or unsubscribed users aren't emailed
+	prefs             notificationPrefs
+	attempts          int
+	createdAt         time.Time
+}
+
+// seatAlert Returns the alert info handed to notification channels for this entry
+func (entry *outboxEntry) seatAlert() *SeatAlert {
+	return &SeatAlert{
+		IdempotencyKey:    entry.idempotencyKey,
+		Email:             entry.email,
+		Term:              entry.term,
+		CourseID:          entry.courseID,
+		CourseName:        entry.courseName,
+		SectionNum:        entry.sectionNum,
+		SectionType:       entry.sectionType,
+		ProfName:          entry.profName,
+		AlertType:         entry.alertType,
+		Expression:        entry.expression,
+		OpenSeats:         entry.openSeats,
+		Capacity:          entry.capacity,
+		CapacityRaised:    entry.capacityRaised,
+		OldCapacity:       entry.oldCapacity,
+		WaitlistOpenSpots: entry.waitlistOpenSpots,
+		WaitlistCapacity:  entry.waitlistCapacity,
+		AlertKept:         entry.alertKept,
+		AlertID:           entry.alertID,
+		ClearedAlternatives:       entry.clearedAlternatives,
+		AlternativesPausedMinutes: entry.alternativesPausedMinutes,
+		SearchResults:     entry.searchResults,
+		ChatWebhookIDs:    entry.chatWebhookIDs,
+		Timestamp:         entry.createdAt,
+		targetsSent:       entry.targetsSent,
+	}
+}
+
+// targetKey Returns name of one of a channel's targets (e.g. a single webhook) as stored in an
+// outbox entry's targets_sent
+func targetKey(channel string, id int64) string {
+	return fmt.Sprintf("%s:%d", channel, id)
+}
+
+// markTargetSent Records that alert was delivered to target so retries of its outbox entry
+// skip it.
+// Returns error if update fails
+func markTargetSent(ctx context.Context, pool DB, alert *SeatAlert, target string) error {
+
+	if _, err := pool.Exec(ctx, `
+		UPDATE notification_outbox
+		SET targets_sent = array_append(targets_sent, $2)
+		WHERE idempotency_key = $1;
+	`, alert.IdempotencyKey, target); err != nil {
+		return fmt.Errorf("Error recording delivery to %s for alert %s: %w", target, alert.IdempotencyKey, err)
+	}
+
+	return nil
+}
+
+// claimOutboxEntries Claims due outbox entries so they aren't sent by another run at the same
+// time. Every due entry of a user is claimed together so a digest is never split across batches,
+// and users are added to the batch until it reaches outboxBatchSize entries (a user with more
+// entries than that is claimed alone). Entries stuck in sending from a run that died are reclaimed
+// once their lease expires.
+// Returns list of claimed entries or error if query fails
+func claimOutboxEntries(ctx context.Context, pool *pgxpool.Pool) ([]*outboxEntry, error) {
+
+	// users are locked while their entries are claimed so two runs can't each claim some of a
+	// user's entries
+	rows, err := pool.Query(ctx, `
+		WITH due_users AS (
+			SELECT user_id, count(*) AS entries
+			FROM notification_outbox
+			WHERE status IN ('pending', 'sending')
+			  AND next_attempt_at <= CURRENT_TIMESTAMP
+			GROUP BY user_id
+		),
+		batch_users AS (
+			SELECT u.id
+			FROM users u
+			JOIN (
+				SELECT user_id, sum(entries) OVER (ORDER BY user_id) - entries AS entries_before
+				FROM due_users
+			) du ON du.user_id = u.id
+			WHERE du.entries_before < $2
+			FOR UPDATE OF u SKIP LOCKED
+		)
+		UPDATE notification_outbox nob
+		SET status          = 'sending',
+		    attempts        = nob.attempts + 1,
+		    next_attempt_at = CURRENT_TIMESTAMP + $1 * INTERVAL '1 second'
+		FROM users u
+		LEFT JOIN user_notification_prefs p ON p.user_id = u.id
+		WHERE u.id = nob.user_id
+		  AND nob.user_id IN (SELECT id FROM batch_users)
+		  AND nob.status IN ('pending', 'sending')
+		  AND nob.next_attempt_at <= CURRENT_TIMESTAMP
+		RETURNING nob.id, nob.idempotency_key, nob.user_id, nob.email, nob.term, nob.course_id,
+		          nob.course_name, nob.section_num, nob.alert_type, nob.seat_threshold, nob.open_seats,
+		          nob.waitlist_open_spots, nob.waitlist_capacity, nob.alert_kept,
+		          COALESCE(nob.section_type, ''), COALESCE(nob.prof_name, ''), COALESCE(nob.capacity, 0),
+		          nob.old_capacity IS NOT NULL, COALESCE(nob.old_capacity, 0), COALESCE(nob.alert_id, 0), COALESCE(nob.expression, ''),
+		          COALESCE(nob.cleared_alternatives, '{}'), COALESCE(nob.alternatives_paused_minutes, 0), COALESCE(nob.group_id, 0),
+		          COALESCE(nob.chat_webhook_ids, '{}'), nob.alert_snapshot,
+		          COALESCE(nob.search_results, '[]'), nob.channels_sent, nob.targets_sent,
+		          u.notification_mode = 'digest', u.email_status,
+		          p.enabled_channels, COALESCE(p.time_zone, ''),
+		          (EXTRACT(HOUR FROM p.quiet_start) * 60 + EXTRACT(MINUTE FROM p.quiet_start))::int,
+		          (EXTRACT(HOUR FROM p.quiet_end) * 60 + EXTRACT(MINUTE FROM p.quiet_end))::int,
+		          COALESCE(p.quiet_seat_alerts, true), COALESCE(p.quiet_mode, 'defer'),
+		          nob.attempts, nob.created_at;
+	`, outboxLease.Seconds(), outboxBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("Error with claiming outbox entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*outboxEntry
+	for rows.Next() {
+		entry := new(outboxEntry)
+		if err := rows.Scan(&entry.id, &entry.idempotencyKey, &entry.userID, &entry.email,
+			&entry.term, &entry.courseID, &entry.courseName, &entry.sectionNum, &entry.alertType,
+			&entry.seatThreshold, &entry.openSeats, &entry.waitlistOpenSpots, &entry.waitlistCapacity, &entry.alertKept,
+			&entry.sectionType, &entry.profName, &entry.capacity, &entry.capacityRaised, &entry.oldCapacity, &entry.alertID, &entry.expression,
+			&entry.clearedAlternatives, &entry.alternativesPausedMinutes, &entry.groupID, &entry.chatWebhookIDs, &entry.alertSnapshot, &entry.searchResults, &entry.channelsSent, &entry.targetsSent, &entry.digest, &entry.emailStatus,
+			&entry.prefs.enabledChannels, &entry.prefs.timeZone, &entry.prefs.quietStart, &entry.prefs.quietEnd,
+			&entry.prefs.quietSeatAlerts, &entry.prefs.quietMode, &entry.attempts, &entry.createdAt); err != nil {
+				return nil, fmt.Errorf("Error with outbox row scan: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with outbox iteration: %w", rows.Err())
+	}
+
+	return entries, nil
+}
+
+// dispatchOutboxEntry Sends entry through every channel it hasn't already been sent through and
+// the user allows at the moment, recording each channel as soon as it succeeds so retries don't
+// resend it. Channels in batched were already sent as part of a batch and only have their result
+// recorded. Marks entry as sent (clearing its alert's group) once every channel succeeds, or defers it until quiet hours end if
+// some channels are being held for them. Otherwise schedules a retry, or marks it failed if out
+// of attempts.
+// Returns error if entry status can't be updated
+func dispatchOutboxEntry(ctx context.Context, pool *pgxpool.Pool, entry *outboxEntry, channels []Notifier,
+	batched map[string]deliveryResult, now time.Time) error {
+
+	alert := entry.seatAlert()
+
+	var sendErrs []error
+	var heldUntil time.Time
+	for _, channel := range channels {
+		if slices.Contains(entry.channelsSent, channel.Channel()) || !entry.enablesChannel(channel.Channel()) {
+			continue
+		}
+
+		// channels held for quiet hours are sent once they end
+		if until, held := entry.heldUntil(channel.Channel(), now); held {
+			heldUntil = until
+			continue
+		}
+
+		result, isBatched := batched[channel.Channel()]
+		if !isBatched {
+			result.messageID, result.err = channel.Notify(ctx, entry.userID, alert)
+		}
+
+		// nothing was sent, so there's no delivery to record and the channel isn't marked as sent
+		if errors.Is(result.err, ErrNoTargets) {
+			continue
+		}
+
+		// history is for auditing only, a failed insert shouldn't stop the alert being sent
+		if err := recordDelivery(ctx, pool, entry, channel.Channel(), result); err != nil {
+			log.Println(err)
+		}
+
+		if err := result.err; err != nil {
+			log.Printf("Error sending %s alert %s to user %d: %v",
+				channel.Channel(), entry.idempotencyKey, entry.userID, err)
+			sendErrs = append(sendErrs, fmt.Errorf("%s: %w", channel.Channel(), err))
+			continue
+		}
+
+		if _, err := pool.Exec(ctx, `
+			UPDATE notification_outbox
+			SET channels_sent = array_append(channels_sent, $2)
+			WHERE id = $1;
+		`, entry.id, channel.Channel()); err != nil {
+			return fmt.Errorf("Error recording %s delivery for outbox entry %d: %w", channel.Channel(), entry.id, err)
+		}
+	}
+
+	var err error
+	switch {
+	case len(sendErrs) == 0 && !heldUntil.IsZero():
+		return deferOutboxEntry(ctx, pool, entry, heldUntil)
+
+	case len(sendErrs) == 0:
+		return markOutboxEntrySent(ctx, pool, entry)
+
+	case entry.attempts >= outboxMaxAttempts:
+		log.Printf("Outbox entry %d failed after %d attempts", entry.id, entry.attempts)
+		_, err = pool.Exec(ctx, `
+			UPDATE notification_outbox
+			SET status = 'failed', last_error = $2
+			WHERE id = $1;
+		`, entry.id, errors.Join(sendErrs...).Error())
+
+		// the alert's group can fire again since this one won't be sent
+		if err == nil && entry.groupID != 0 {
+			err = releaseGroupAlternatives(ctx, pool, entry.groupID, entry.alertID)
+		}
+
+	default:
+		backoff := outboxInitialBackoff << (entry.attempts - 1)
+		_, err = pool.Exec(ctx, `
+			UPDATE notification_outbox
+			SET status          = 'pending',
+			    last_error      = $2,
+			    next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+			WHERE id = $1;
+		`, entry.id, errors.Join(sendErrs...).Error(), backoff.Seconds())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error updating outbox entry %d status: %w", entry.id, err)
+	}
+
+	return nil
+}
+
+// markOutboxEntrySent Marks entry as sent and clears the other alerts in its alert's group, which
+// were held until now, in one transaction.
+// Returns error if entry or group can't be updated
+func markOutboxEntrySent(ctx context.Context, pool *pgxpool.Pool, entry *outboxEntry) error {
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Error starting outbox entry %d transaction: %w", entry.id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE notification_outbox
+		SET status = 'sent', sent_at = CURRENT_TIMESTAMP, last_error = NULL
+		WHERE id = $1;
+	`, entry.id); err != nil {
+		return fmt.Errorf("Error updating outbox entry %d status: %w", entry.id, err)
+	}
+
+	if entry.groupID != 0 {
+		if err := clearGroupAlternatives(ctx, tx, entry.groupID, entry.alertID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Error committing outbox entry %d: %w", entry.id, err)
+	}
+
+	return nil
+}
+
+// deferOutboxEntry Puts claimed entry back in the outbox to be sent once the user's quiet hours
+// end, without counting the claim as an attempt.
+// Returns error if entry can't be updated
+func deferOutboxEntry(ctx context.Context, pool *pgxpool.Pool, entry *outboxEntry, until time.Time) error {
+
+	if _, err := pool.Exec(ctx, `
+		UPDATE notification_outbox
+		SET status          = 'pending',
+		    attempts        = attempts - 1,
+		    next_attempt_at = $2
+		WHERE id = $1;
+	`, entry.id, until); err != nil {
+		return fmt.Errorf("Error deferring outbox entry %d: %w", entry.id, err)
+	}
+
+	return nil
+}
+
+// sendDigests Sends each digest mode user's entries in the batch as a single message through
+// every channel that supports batching. Users with only one entry are sent normally.
+// Returns results of batch sends keyed by entry ID and channel
+func sendDigests(ctx context.Context, entries []*outboxEntry, channels []Notifier, now time.Time) map[int64]map[string]deliveryResult {
+
+	// group digest entries by user
+	userEntries := make(map[int][]*outboxEntry)
+	for _, entry := range entries {
+		if entry.digest {
+			userEntries[entry.userID] = append(userEntries[entry.userID], entry)
+		}
+	}
+
+	results := make(map[int64]map[string]deliveryResult)
+	for userID, group := range userEntries {
+		if len(group) < 2 {
+			continue
+		}
+
+		for _, channel := range channels {
+			batchChannel, ok := channel.(BatchNotifier)
+			if !ok {
+				continue
+			}
+
+			// only include entries that haven't been sent through this channel yet and are allowed to be
+			var pending []*outboxEntry
+			var alerts []*SeatAlert
+			for _, entry := range group {
+				if !slices.Contains(entry.channelsSent, channel.Channel()) && entry.allowsChannel(channel.Channel(), now) {
+					pending = append(pending, entry)
+					alerts = append(alerts, entry.seatAlert())
+				}
+			}
+			if len(pending) < 2 {
+				continue
+			}
+
+			messageID, err := batchChannel.NotifyBatch(ctx, userID, alerts)
+			log.Printf("Sent %s digest of %d alerts to user %d (err=%v)", channel.Channel(), len(alerts), userID, err)
+
+			for _, entry := range pending {
+				if results[entry.id] == nil {
+					results[entry.id] = make(map[string]deliveryResult)
+				}
+				results[entry.id][channel.Channel()] = deliveryResult{messageID: messageID, err: err, batch: digestBatch}
+			}
+		}
+	}
+
+	return results
+}
+
+// sendBulk Sends entries through channels that can send many users' alerts in one request,
+// skipping entries already sent through the channel or batched into a digest. Results are added
+// to batched so entries only have them recorded.
+func sendBulk(ctx context.Context, entries []*outboxEntry, channels []Notifier,
+	batched map[int64]map[string]deliveryResult, now time.Time) {
+
+	for _, channel := range channels {
+		bulkChannel, ok := channel.(bulkNotifier)
+		if !ok {
+			continue
+		}
+
+		var pending []*outboxEntry
+		var userIDs []int
+		var alerts []*SeatAlert
+		for _, entry := range entries {
+			_, isBatched := batched[entry.id][channel.Channel()]
+			if isBatched || slices.Contains(entry.channelsSent, channel.Channel()) || !entry.allowsChannel(channel.Channel(), now) {
+				continue
+			}
+			pending = append(pending, entry)
+			userIDs = append(userIDs, entry.userID)
+			alerts = append(alerts, entry.seatAlert())
+		}
+		if len(pending) < 2 {
+			continue
+		}
+
+		results := bulkChannel.notifyBulk(ctx, userIDs, alerts)
+		log.Printf("Sent %d of %d %s alerts in bulk", len(results), len(pending), channel.Channel())
+
+		for i, result := range results {
+			entry := pending[i]
+			result.batch = bulkBatch
+			if batched[entry.id] == nil {
+				batched[entry.id] = make(map[string]deliveryResult)
+			}
+			batched[entry.id][channel.Channel()] = result
+		}
+	}
+}
+
+// dispatchConcurrently Dispatches entries with a bounded pool of workers. Sends are still kept
+// under each channel's rate limit, which is shared between workers.
+// Returns first error updating an entry's status
+func dispatchConcurrently(ctx context.Context, pool *pgxpool.Pool, entries []*outboxEntry, channels []Notifier,
+	batched map[int64]map[string]deliveryResult, now time.Time) error {
+
+	jobs := make(chan *outboxEntry)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for range min(outboxWorkers, len(entries)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				if err := dispatchOutboxEntry(ctx, pool, entry, channels, batched[entry.id], now); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// DispatchOutbox Sends every due alert in the notification outbox through the given channels,
+// grouping alerts for digest mode users into one message per channel and sending other alerts in
+// bulk where supported. Remaining sends are spread over a pool of workers.
+// A failed send only affects its own entry, which is retried with backoff on a later run.
+// Returns error if outbox can't be queried or updated
+func DispatchOutbox(ctx context.Context, pool *pgxpool.Pool, channels []Notifier) error {
+
+	var sent, deferredCount int
+	for {
+		entries, err := claimOutboxEntries(ctx, pool)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		// hold back entries for users in quiet hours who want alerts deferred
+		now := time.Now()
+		var ready []*outboxEntry
+		for _, entry := range entries {
+			if until, deferred := entry.deferUntil(now); deferred {
+				if err := deferOutboxEntry(ctx, pool, entry, until); err != nil {
+					return err
+				}
+				deferredCount++
+				continue
+			}
+			ready = append(ready, entry)
+		}
+
+		// make sure sections still match with fresh seat info
+		if RecheckSeats {
+			if ready, err = recheckEntries(ctx, pool, ready, now); err != nil {
+				return err
+			}
+		}
+
+		batched := sendDigests(ctx, ready, channels, now)
+		sendBulk(ctx, ready, channels, batched, now)
+
+		if err := dispatchConcurrently(ctx, pool, ready, channels, batched, now); err != nil {
+			return err
+		}
+		sent += len(ready)
+	}
+
+	log.Printf("Dispatched %d outbox entries, deferred %d for quiet hours", sent, deferredCount)
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+	_ "time/tzdata"
+)
+
+// time zone used when a user's can't be loaded
+const defaultTimeZone = "America/Chicago"
+
+// channels alerts can be sent through
+var notificationChannels = []string{"email", "webhook", "chat", "push"}
+
+// channels that don't interrupt the user, used during quiet hours in quiet_channels mode
+var quietChannels = []string{"email", "webhook"}
+
+// alert types sent when seats open up, the others (new sections, expiry notices) are informational
+var seatAlertTypes = []string{"any", "threshold", "waitlist", "expression", "any_package", "search"}
+
+// user's notification preferences from user_notification_prefs
+type notificationPrefs struct {
+	enabledChannels []string // every channel if nil
+	timeZone        string
+
+	// minutes after midnight quiet hours start and end, no quiet hours if nil
+	quietStart *int
+	quietEnd   *int
+
+	quietSeatAlerts bool
+	quietMode       string
+}
+
+// location Returns user's time zone, falling back to the default if it's invalid
+func (prefs *notificationPrefs) location() *time.Location {
+
+	if prefs.timeZone != "" {
+		location, err := time.LoadLocation(prefs.timeZone)
+		if err == nil {
+			return location
+		}
+		log.Printf("Invalid time zone %q, using %s", prefs.timeZone, defaultTimeZone)
+	}
+
+	location, _ := time.LoadLocation(defaultTimeZone)
+	return location
+}
+
+// quietUntil Checks whether given time falls in the user's quiet hours.
+// Returns when quiet hours end and whether time is in quiet hours
+func (prefs *notificationPrefs) quietUntil(now time.Time) (time.Time, bool) {
+
+	if prefs.quietStart == nil || prefs.quietEnd == nil || *prefs.quietStart == *prefs.quietEnd {
+		return time.Time{}, false
+	}
+
+	local := now.In(prefs.location())
+	minute := local.Hour()*60 + local.Minute()
+	start, end := *prefs.quietStart, *prefs.quietEnd
+
+	// quiet hours can wrap past midnight (e.g. 22:00 to 07:00)
+	var quiet bool
+	if start < end {
+		quiet = minute >= start && minute < end
+	} else {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+
+	return until, true
+}
+
+// isSeatAlert Returns whether entry is for a seat opening rather than an informational alert
+func (entry *outboxEntry) isSeatAlert() bool {
+	return slices.Contains(seatAlertTypes, entry.alertType)
+}
+
+// quietUntil Returns when the user's quiet hours end and whether they apply to entry at given time
+func (entry *outboxEntry) quietUntil(now time.Time) (time.Time, bool) {
+
+	until, quiet := entry.prefs.quietUntil(now)
+	if !quiet || (entry.isSeatAlert() && !entry.prefs.quietSeatAlerts) {
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// deferUntil Returns when entry should be sent instead and whether it should be held back
+func (entry *outboxEntry) deferUntil(now time.Time) (time.Time, bool) {
+
+	until, quiet := entry.quietUntil(now)
+	if !quiet || entry.prefs.quietMode != "defer" {
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// enablesChannel Returns whether entry is ever sent through channel, given the user's email
+// status and enabled channels
+func (entry *outboxEntry) enablesChannel(channel string) bool {
+
+	// a suppressed email address only stops email, other channels are still sent
+	if channel == "email" && entry.emailStatus != "ok" {
+		return false
+	}
+
+	return entry.prefs.enabledChannels == nil || slices.Contains(entry.prefs.enabledChannels, channel)
+}
+
+// heldUntil Returns when the user's quiet hours end and whether channel is held back until then
+// at given time, which only happens to interrupting channels in quiet_channels mode
+func (entry *outboxEntry) heldUntil(channel string, now time.Time) (time.Time, bool) {
+
+	if entry.prefs.quietMode != "quiet_channels" || slices.Contains(quietChannels, channel) {
+		return time.Time{}, false
+	}
+
+	return entry.quietUntil(now)
+}
+
+// allowsChannel Returns whether entry can be sent through channel at given time, given the
+// user's email status, enabled channels and quiet hours
+func (entry *outboxEntry) allowsChannel(channel string, now time.Time) bool {
+	_, held := entry.heldUntil(channel, now)
+	return entry.enablesChannel(channel) && !held
+}
+
+// SetNotificationMode Sets whether the user gets an email per alert ('instant') or one email per
+// run listing all of their alerts ('digest').
+// Returns error if mode is unknown or user doesn't exist
+func SetNotificationMode(ctx context.Context, pool DB, userID int, mode string) error {
+
+	if mode != "instant" && mode != "digest" {
+		return fmt.Errorf("Unknown notification mode %q, must be instant or digest", mode)
+	}
+
+	tag, err := pool.Exec(ctx, `
+		UPDATE users SET notification_mode = $2 WHERE id = $1;
+	`, userID, mode)
+	if err != nil {
+		return fmt.Errorf("Error setting notification mode for user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("User %d not found", userID)
+	}
+
+	return nil
+}
+
+// NotificationPrefs is how and when a user wants to be contacted, as saved in user_notification_prefs
+type NotificationPrefs struct {
+	EnabledChannels []string // email, webhook, chat and/or push
+	TimeZone        string   // IANA time zone, America/Chicago if empty
+	QuietStart      string   // local time quiet hours start (e.g. 22:00), no quiet hours if empty
+	QuietEnd        string   // local time quiet hours end (e.g. 07:00), can be before QuietStart
+	QuietSeatAlerts bool     // whether quiet hours also hold back seat alerts
+	QuietMode       string   // defer or quiet_channels, defer if empty
+}
+
+// validate Checks channels, time zone, quiet hours and quiet mode, filling in defaults.
+// Returns error describing the first invalid preference
+func (prefs *NotificationPrefs) validate() error {
+
+	if len(prefs.EnabledChannels) == 0 {
+		return fmt.Errorf("At least one notification channel must be enabled")
+	}
+	for i, channel := range prefs.EnabledChannels {
+		if !slices.Contains(notificationChannels, channel) {
+			return fmt.Errorf("Unknown notification channel %q, must be one of %v", channel, notificationChannels)
+		}
+		if slices.Contains(prefs.EnabledChannels[:i], channel) {
+			return fmt.Errorf("Notification channel %q is listed twice", channel)
+		}
+	}
+
+	if prefs.TimeZone == "" {
+		prefs.TimeZone = defaultTimeZone
+	}
+	if _, err := time.LoadLocation(prefs.TimeZone); err != nil {
+		return fmt.Errorf("Unknown time zone %q", prefs.TimeZone)
+	}
+
+	if (prefs.QuietStart == "") != (prefs.QuietEnd == "") {
+		return fmt.Errorf("Quiet hours need both a start and an end")
+	}
+	for _, quietTime := range []string{prefs.QuietStart, prefs.QuietEnd} {
+		if _, err := time.Parse("15:04", quietTime); quietTime != "" && err != nil {
+			return fmt.Errorf("Invalid quiet hours time %q, must be HH:MM", quietTime)
+		}
+	}
+
+	if prefs.QuietMode == "" {
+		prefs.QuietMode = "defer"
+	}
+	if prefs.QuietMode != "defer" && prefs.QuietMode != "quiet_channels" {
+		return fmt.Errorf("Unknown quiet mode %q, must be defer or quiet_channels", prefs.QuietMode)
+	}
+
+	return nil
+}
+
+// SaveNotificationPrefs Validates and saves the user's notification preferences, replacing any
+// they had before.
+// Returns error if a preference is invalid or they can't be saved
+func SaveNotificationPrefs(ctx context.Context, pool DB, userID int, prefs NotificationPrefs) error {
+
+	if err := prefs.validate(); err != nil {
+		return err
+	}
+
+	_, err := pool.Exec(ctx, `
+		INSERT INTO user_notification_prefs (
+			user_id, enabled_channels, time_zone, quiet_start, quiet_end, quiet_seat_alerts, quiet_mode
+		)
+		VALUES ($1, $2, $3, NULLIF($4, '')::time, NULLIF($5, '')::time, $6, $7)
+		ON CONFLICT (user_id)
+		DO UPDATE SET enabled_channels  = EXCLUDED.enabled_channels,
+		              time_zone         = EXCLUDED.time_zone,
+		              quiet_start       = EXCLUDED.quiet_start,
+		              quiet_end         = EXCLUDED.quiet_end,
+		              quiet_seat_alerts = EXCLUDED.quiet_seat_alerts,
+		              quiet_mode        = EXCLUDED.quiet_mode,
+		              updated_at        = CURRENT_TIMESTAMP;
+	`, userID, prefs.EnabledChannels, prefs.TimeZone, prefs.QuietStart, prefs.QuietEnd, prefs.QuietSeatAlerts,
+		prefs.QuietMode)
+	if err != nil {
+		return fmt.Errorf("Error saving notification preferences for user %d: %w", userID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// execDB records Exec calls and reports rowsAffected rows changed, other methods aren't used
+type execDB struct {
+	rowsAffected int
+	args         [][]any
+}
+
+func (db *execDB) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
+	db.args = append(db.args, arguments)
+	return pgconn.NewCommandTag(fmt.Sprintf("UPDATE %d", db.rowsAffected)), nil
+}
+
+func (db *execDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	panic("unexpected Query")
+}
+
+func (db *execDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	panic("unexpected QueryRow")
+}
+
+func (db *execDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	panic("unexpected Begin")
+}
+
+func TestSetNotificationMode(t *testing.T) {
+
+	for _, mode := range []string{"instant", "digest"} {
+		db := &execDB{rowsAffected: 1}
+		if err := SetNotificationMode(context.Background(), db, 7, mode); err != nil {
+			t.Fatalf("SetNotificationMode(%q) returned error: %v", mode, err)
+		}
+		if len(db.args) != 1 || db.args[0][0] != 7 || db.args[0][1] != mode {
+			t.Errorf("SetNotificationMode(%q) ran %v, want user 7 set to %q", mode, db.args, mode)
+		}
+	}
+}
+
+func TestSetNotificationModeInvalid(t *testing.T) {
+
+	for _, mode := range []string{"", "Digest", "weekly"} {
+		db := &execDB{rowsAffected: 1}
+		if err := SetNotificationMode(context.Background(), db, 7, mode); err == nil {
+			t.Errorf("SetNotificationMode(%q) returned no error", mode)
+		}
+		if len(db.args) != 0 {
+			t.Errorf("SetNotificationMode(%q) updated the DB", mode)
+		}
+	}
+}
+
+func TestSetNotificationModeMissingUser(t *testing.T) {
+
+	db := &execDB{rowsAffected: 0}
+	if err := SetNotificationMode(context.Background(), db, 7, "digest"); err == nil {
+		t.Error("SetNotificationMode for a missing user returned no error")
+	}
+}
@@ -0,0 +1,172 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SeatAlert holds the section info for an alert that has been set off, passed to each
+// notification channel
+type SeatAlert struct {
+	IdempotencyKey    string
+	Email             string
+	Term              int
+	CourseID          string
+	CourseName        string
+	SectionNum        string
+	SectionType       string
+	ProfName          string
+	AlertType         string
+	Expression        string // expression that matched for expression alerts
+	OpenSeats         int
+	Capacity          int
+	CapacityRaised    bool // new section alert sent because the section's capacity went up
+	OldCapacity       int
+	WaitlistOpenSpots int
+	WaitlistCapacity  int
+	AlertKept         bool
+	AlertID           int64 // alert that fired if it was kept, 0 otherwise
+
+	// other alerts in the alert's group that were cleared when it fired, and how long they were
+	// paused for (0 if they were cancelled)
+	ClearedAlternatives       []string
+	AlternativesPausedMinutes int
+
+	// open sections matching the saved search for search alerts, best first (the alert's own
+	// section fields hold the first one)
+	SearchResults     []SearchResult
+
+	ChatWebhookIDs    []int64 // chat webhooks attached to the alert
+	Timestamp         time.Time
+
+	// targets the alert was already delivered to by an earlier attempt
+	targetsSent       []string
+}
+
+// ErrNoTargets is returned by a Notifier when the user has nothing set up for its channel (e.g. no
+// webhooks), so nothing was sent and there's no delivery to record
+var ErrNoTargets = errors.New("no targets for channel")
+
+// Notifier is a notification channel (webhook, chat, etc.) that alerts are sent through in
+// addition to email
+type Notifier interface {
+
+	// Channel Returns name of notification channel
+	Channel() string
+
+	// Notify Sends alert to all of the user's targets for this channel.
+	// Returns provider message ID if the channel has one, ErrNoTargets if the user has no targets
+	// for the channel, or error if delivery fails.
+	Notify(ctx context.Context, userID int, alert *SeatAlert) (string, error)
+}
+
+// BatchNotifier is a notification channel that can send several of a user's alerts in a single
+// message (e.g. digest emails)
+type BatchNotifier interface {
+	Notifier
+
+	// NotifyBatch Sends all given alerts to the user in one message.
+	// Returns provider message ID if the channel has one, or error if delivery fails.
+	NotifyBatch(ctx context.Context, userID int, alerts []*SeatAlert) (string, error)
+}
+
+// sentTo Returns whether alert was already delivered to target by an earlier attempt
+func (alert *SeatAlert) sentTo(target string) bool {
+	return slices.Contains(alert.targetsSent, target)
+}
+
+// isWaitlist Returns whether alert is for a waitlist opening rather than an open seat
+func (alert *SeatAlert) isWaitlist() bool {
+	return alert.AlertType == "waitlist"
+}
+
+// isExpression Returns whether alert is for a custom expression matching its section
+func (alert *SeatAlert) isExpression() bool {
+	return alert.AlertType == "expression"
+}
+
+// isSearch Returns whether alert is for sections matching one of the user's saved searches
+func (alert *SeatAlert) isSearch() bool {
+	return alert.AlertType == "search"
+}
+
+// isExpired Returns whether alert is a notice that the user's alert expired without going off
+func (alert *SeatAlert) isExpired() bool {
+	return alert.AlertType == "expired"
+}
+
+// isNewSection Returns whether alert is for a section that was just added to a course
+func (alert *SeatAlert) isNewSection() bool {
+	return alert.AlertType == "new_section"
+}
+
+// isPackage Returns whether alert is for a whole enrollment package (e.g. LEC + DIS) of a course
+// rather than a single section
+func (alert *SeatAlert) isPackage() bool {
+	return alert.AlertType == "any_package"
+}
+
+// title Returns short headline for alert
+func (alert *SeatAlert) title() string {
+	if alert.isPackage() {
+		return fmt.Sprintf("Open way into %s", alert.CourseName)
+	}
+	if alert.isExpired() {
+		return fmt.Sprintf("Alert expired for %s", alert.CourseName)
+	}
+	if alert.isNewSection() && alert.CapacityRaised {
+		return fmt.Sprintf("More seats added to %s", alert.CourseName)
+	}
+	if alert.isNewSection() {
+		return fmt.Sprintf("New section added to %s", alert.CourseName)
+	}
+	if alert.isWaitlist() {
+		return fmt.Sprintf("Waitlist spot open in %s", alert.CourseName)
+	}
+	if alert.isExpression() {
+		return fmt.Sprintf("Alert rule matched in %s", alert.CourseName)
+	}
+	if alert.isSearch() {
+		return fmt.Sprintf("Saved search: %d open section(s)", len(alert.SearchResults))
+	}
+	return fmt.Sprintf("Seat open in %s", alert.CourseName)
+}
+
+// summary Returns one sentence description of what opened in the alert's section
+func (alert *SeatAlert) summary() string {
+	if alert.isPackage() {
+		return fmt.Sprintf("Every section of %s is open, with at least %d open seat(s) each.",
+			alert.SectionNum, alert.OpenSeats)
+	}
+	if alert.isExpired() {
+		return fmt.Sprintf("Your alert for section %s expired before it went off and has been removed.", alert.SectionNum)
+	}
+	if alert.isNewSection() && alert.CapacityRaised {
+		return fmt.Sprintf("%s section %s's capacity was raised from %d to %d, with %d seat(s) open.",
+			alert.SectionType, alert.SectionNum, alert.OldCapacity, alert.Capacity, alert.OpenSeats)
+	}
+	if alert.isNewSection() {
+		return fmt.Sprintf("New %s section %s was added with %d of %d seat(s) open.",
+			alert.SectionType, alert.SectionNum, alert.OpenSeats, alert.Capacity)
+	}
+	if alert.isWaitlist() {
+		return fmt.Sprintf("Section %s is full, but its waitlist now has %d open spot(s). This is a waitlist spot, not a seat.%s",
+			alert.SectionNum, alert.WaitlistOpenSpots, alert.alternativesSummary())
+	}
+	if alert.isExpression() {
+		return fmt.Sprintf("Section %s matched your rule %s, with %d open seat(s) and %d open waitlist spot(s).%s",
+			alert.SectionNum, alert.Expression, alert.OpenSeats, alert.WaitlistOpenSpots, alert.alternativesSummary())
+	}
+	if alert.isSearch() {
+		var others string
+		if len(alert.SearchResults) > 1 {
+			others = fmt.Sprintf(" %d other matching section(s) are open too.", len(alert.SearchResults)-1)
+		}
+		return fmt.Sprintf("%s %s section %s matches your saved search and has %d of %d seat(s) open.%s",
+			alert.CourseName, alert.SectionType, alert.SectionNum, alert.OpenSeats, alert.Capacity, others)
+	}
+	return fmt.Sprintf("Section %s now has %d open seat(s).%s", alert.SectionNum, alert.OpenSeats, alert.alternativesSummary())
+}
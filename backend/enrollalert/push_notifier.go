@@ -0,0 +1,441 @@
+package enrollalert
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	pushTimeout    = 10 * time.Second
+	pushTTL        = 60 * 60
+	pushRecordSize = 4096
+	vapidTokenLife = 12 * time.Hour
+)
+
+// PushSubscriptionJSON is a browser push subscription as returned by PushSubscription.toJSON()
+type PushSubscriptionJSON struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type pushSubscription struct {
+	id       int64
+	endpoint string
+	p256dh   string
+	auth     string
+}
+
+// structure of notification payload handed to the service worker
+type pushPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	Tag   string `json:"tag"`
+}
+
+type PushNotifier struct {
+	pool      *pgxpool.Pool
+	client    *http.Client
+	vapidKey  *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+}
+
+// decodeBase64URL Decodes base64url string with or without padding, as browsers and key
+// generators aren't consistent about it.
+// Returns decoded bytes or error if string isn't valid base64url
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// NewPushNotifier creates Web Push notifier from base64url encoded VAPID key pair (as generated
+// by web-push libraries) and VAPID subject (mailto: or https: contact URL)
+func NewPushNotifier(pool *pgxpool.Pool, publicKey string, privateKey string, subject string) (*PushNotifier, error) {
+
+	rawPrivate, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding VAPID private key: %w", err)
+	}
+
+	ecdhKey, err := ecdh.P256().NewPrivateKey(rawPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid VAPID private key: %w", err)
+	}
+
+	// public key is an uncompressed point (0x04 || X || Y)
+	rawPublic := ecdhKey.PublicKey().Bytes()
+	if publicKey != "" && publicKey != base64.RawURLEncoding.EncodeToString(rawPublic) {
+		return nil, fmt.Errorf("VAPID public key doesn't match private key")
+	}
+
+	vapidKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(rawPublic[1:33]),
+			Y:     new(big.Int).SetBytes(rawPublic[33:]),
+		},
+		D: new(big.Int).SetBytes(rawPrivate),
+	}
+
+	return &PushNotifier{
+		pool:      pool,
+		client:    newPublicHTTPClient(pushTimeout),
+		vapidKey:  vapidKey,
+		publicKey: base64.RawURLEncoding.EncodeToString(rawPublic),
+		subject:   subject,
+	}, nil
+}
+
+// Channel Returns name of Web Push notification channel
+func (p *PushNotifier) Channel() string {
+	return "push"
+}
+
+// vapidAuthorization Creates VAPID (RFC 8292) Authorization header for push service that owns
+// the endpoint, signed with an ES256 JWT.
+// Returns header value or error if signing fails
+func (p *PushNotifier) vapidAuthorization(endpoint string) (string, error) {
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("Invalid push endpoint: %w", err)
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": parsed.Scheme + "://" + parsed.Host,
+		"exp": time.Now().Add(vapidTokenLife).Unix(),
+		"sub": p.subject,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	r, s, err := ecdsa.Sign(rand.Reader, p.vapidKey, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing VAPID token: %w", err)
+	}
+
+	// JWS ES256 signatures are fixed length r || s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, p.publicKey), nil
+}
+
+// encryptPushPayload Encrypts payload for subscription using aes128gcm content encoding as
+// described in RFC 8291.
+// Returns encrypted body or error if subscription keys are invalid
+func encryptPushPayload(sub pushSubscription, payload []byte) ([]byte, error) {
+
+	uaPublicRaw, err := decodeBase64URL(sub.p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding p256dh key: %w", err)
+	}
+	authSecret, err := decodeBase64URL(sub.auth)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding auth secret: %w", err)
+	}
+
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicRaw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid p256dh key: %w", err)
+	}
+
+	// ephemeral application server key pair used only for this message
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicRaw := asPrivate.PublicKey().Bytes()
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// combine ECDH secret with auth secret to get input keying material
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicRaw...)
+	keyInfo = append(keyInfo, asPublicRaw...)
+
+	prkKey := hmac.New(sha256.New, authSecret)
+	prkKey.Write(ecdhSecret)
+
+	ikm, err := hkdf.Expand(sha256.New, prkKey.Sum(nil), string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// derive content encryption key and nonce with random salt
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// payload is sent as a single record ending with the 0x02 delimiter
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > pushRecordSize {
+		return nil, fmt.Errorf("Push payload too large (%d bytes)", len(payload))
+	}
+
+	// header is salt || record size || key id length || key id (application server public key)
+	body := make([]byte, 0, 21+len(asPublicRaw)+len(plaintext)+gcm.Overhead())
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, pushRecordSize)
+	body = append(body, byte(len(asPublicRaw)))
+	body = append(body, asPublicRaw...)
+	body = gcm.Seal(body, nonce, plaintext, nil)
+
+	return body, nil
+}
+
+// getUserPushSubscriptions Queries browser push subscriptions for given user.
+// Returns list of subscriptions or error if query fails
+func (p *PushNotifier) getUserPushSubscriptions(ctx context.Context, userID int) ([]pushSubscription, error) {
+
+	rows, err := p.pool.Query(ctx, `
+		SELECT id, endpoint, p256dh, auth
+		FROM push_subscriptions
+		WHERE user_id = $1;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error with push subscription query: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []pushSubscription
+	for rows.Next() {
+		var sub pushSubscription
+		if err := rows.Scan(&sub.id, &sub.endpoint, &sub.p256dh, &sub.auth); err != nil {
+			return nil, fmt.Errorf("Error with push subscription row scan: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with push subscription iteration: %w", rows.Err())
+	}
+
+	return subs, nil
+}
+
+// sendPush Encrypts and sends payload to subscription's push service endpoint.
+// Returns push service status code or error if request couldn't be sent
+func (p *PushNotifier) sendPush(ctx context.Context, sub pushSubscription, payload []byte) (int, error) {
+
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	authorization, err := p.vapidAuthorization(sub.endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", sub.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("Error while creating POST request: %w", err)
+	}
+
+	request.Header.Set("Authorization", authorization)
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", fmt.Sprintf("%d", pushTTL))
+	request.Header.Set("Urgency", "high")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	return response.StatusCode, nil
+}
+
+// Notify Pushes seat alert to each of the user's browser subscriptions it hasn't already been
+// pushed to, removing subscriptions the push service reports as expired or unsubscribed.
+// Returns ErrNoTargets if the user has no subscriptions, or error if subscriptions can't be queried
+// or any push fails
+func (p *PushNotifier) Notify(ctx context.Context, userID int, alert *SeatAlert) (string, error) {
+
+	subs, err := p.getUserPushSubscriptions(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if len(subs) == 0 {
+		return "", ErrNoTargets
+	}
+
+	payload, err := json.Marshal(pushPayload{
+		Title: alert.title(),
+		Body:  alert.summary(),
+		URL:   enrollURL(alert),
+		Tag:   fmt.Sprintf("%s-%s", alert.CourseID, alert.SectionNum),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error with push payload marshal: %w", err)
+	}
+
+	var firstErr error
+	for _, sub := range subs {
+		target := targetKey(p.Channel(), sub.id)
+		if alert.sentTo(target) {
+			continue
+		}
+
+		status, err := p.sendPush(ctx, sub, payload)
+
+		switch {
+		case err != nil:
+			err = fmt.Errorf("Push to subscription %d failed: %w", sub.id, err)
+
+		// subscription is gone, remove it so we stop pushing to it
+		case status == http.StatusNotFound || status == http.StatusGone:
+			log.Printf("Pruning expired push subscription %d for user %d", sub.id, userID)
+			if err := deletePushSubscription(ctx, p.pool, sub.id); err != nil {
+				log.Println(err)
+			}
+
+		case status < 200 || status >= 300:
+			err = fmt.Errorf("Push service responded with status %d for subscription %d", status, sub.id)
+
+		default:
+			if _, err := p.pool.Exec(ctx, `
+				UPDATE push_subscriptions SET last_success_at = CURRENT_TIMESTAMP WHERE id = $1
+			`, sub.id); err != nil {
+				log.Printf("Error updating push subscription %d: %v", sub.id, err)
+			}
+			if err := markTargetSent(ctx, p.pool, alert, target); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if err != nil {
+			log.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return "", firstErr
+}
+
+// validate Checks that subscription has an https endpoint and keys of the right size for
+// encrypting payloads (a P-256 public key and a 16 byte auth secret).
+// Returns error describing what's wrong with the subscription
+func (sub *PushSubscriptionJSON) validate() error {
+
+	if err := requireHTTPS(sub.Endpoint); err != nil {
+		return fmt.Errorf("Invalid push endpoint: %w", err)
+	}
+	if key, err := decodeBase64URL(sub.Keys.P256dh); err != nil || len(key) != 65 {
+		return errors.New("Push subscription p256dh key must be a base64url encoded P-256 public key")
+	}
+	if secret, err := decodeBase64URL(sub.Keys.Auth); err != nil || len(secret) != 16 {
+		return errors.New("Push subscription auth secret must be 16 base64url encoded bytes")
+	}
+	return nil
+}
+
+// SavePushSubscription Validates and saves a browser push subscription for the user. Browsers
+// keep the same endpoint when resubscribing, so an existing subscription is updated (and moved
+// to the user if another account had it).
+// Returns ID of subscription or error if it's invalid or can't be saved
+func SavePushSubscription(ctx context.Context, pool DB, userID int, sub PushSubscriptionJSON, userAgent string) (int64, error) {
+
+	if err := sub.validate(); err != nil {
+		return 0, err
+	}
+
+	var subID int64
+	if err := pool.QueryRow(ctx, `
+		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth, user_agent)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (endpoint)
+		DO UPDATE SET user_id    = EXCLUDED.user_id,
+		              p256dh     = EXCLUDED.p256dh,
+		              auth       = EXCLUDED.auth,
+		              user_agent = EXCLUDED.user_agent
+		RETURNING id;
+	`, userID, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, userAgent).Scan(&subID); err != nil {
+		return 0, fmt.Errorf("Error saving push subscription: %w", err)
+	}
+
+	return subID, nil
+}
+
+// RemovePushSubscription Removes the user's push subscription with given endpoint (e.g. after the
+// browser unsubscribes).
+// Returns whether a subscription was removed or error if delete fails
+func RemovePushSubscription(ctx context.Context, pool DB, userID int, endpoint string) (bool, error) {
+
+	tag, err := pool.Exec(ctx, `
+		DELETE FROM push_subscriptions WHERE user_id = $1 AND endpoint = $2;
+	`, userID, endpoint)
+	if err != nil {
+		return false, fmt.Errorf("Error removing push subscription: %w", err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// deletePushSubscription Removes subscription the push service reported as expired.
+// Returns error if delete fails
+func deletePushSubscription(ctx context.Context, pool DB, subID int64) error {
+	if _, err := pool.Exec(ctx, `DELETE FROM push_subscriptions WHERE id = $1`, subID); err != nil {
+		return fmt.Errorf("Error pruning push subscription %d: %w", subID, err)
+	}
+	return nil
+}
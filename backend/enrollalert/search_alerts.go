@@ -0,0 +1,198 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// most sections sent for one search, the best (most open seats) are sent first
+const maxSearchResults = 25
+
+// SearchAlert is a saved search over every course's sections, unset filters match everything
+type SearchAlert struct {
+	BreadthCodes []string // course has any of these breadths
+	SubjectID    *int
+	CatalogMin   *int
+	CatalogMax   *int
+	SectionType  string
+}
+
+// validate Checks that search narrows down courses and has a valid catalog number range.
+// Returns error describing what's wrong with the search
+func (search *SearchAlert) validate() error {
+	if len(search.BreadthCodes) == 0 && search.SubjectID == nil {
+		return errors.New("Search needs at least one breadth or a subject")
+	}
+	if (search.CatalogMin != nil && *search.CatalogMin < 0) || (search.CatalogMax != nil && *search.CatalogMax < 0) {
+		return errors.New("Catalog numbers can't be negative")
+	}
+	if search.CatalogMin != nil && search.CatalogMax != nil && *search.CatalogMin > *search.CatalogMax {
+		return errors.New("Catalog number range is backwards")
+	}
+	return nil
+}
+
+// SaveSearchAlert Validates search and saves it as a search alert for the user in given term.
+// Returns ID of new search alert or error if search is invalid or can't be saved
+func SaveSearchAlert(ctx context.Context, pool DB, userID int, term int, search SearchAlert) (int64, error) {
+
+	if err := search.validate(); err != nil {
+		return 0, err
+	}
+
+	var sectionType *string
+	if search.SectionType != "" {
+		sectionType = &search.SectionType
+	}
+
+	breadthCodes := search.BreadthCodes
+	if breadthCodes == nil {
+		breadthCodes = []string{}
+	}
+
+	var searchID int64
+	if err := pool.QueryRow(ctx, `
+		INSERT INTO search_alerts (user_id, term, breadth_codes, subject_id, catalog_min, catalog_max, section_type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id;
+	`, userID, term, breadthCodes, search.SubjectID, search.CatalogMin, search.CatalogMax, sectionType).Scan(&searchID); err != nil {
+		return 0, fmt.Errorf("Error saving search alert: %w", err)
+	}
+
+	return searchID, nil
+}
+
+// SearchResult is an open section matching a saved search, as listed in the search's alert
+type SearchResult struct {
+	CourseID          string `json:"course_id"`
+	CourseName        string `json:"course_name"`
+	SectionNum        string `json:"section_num"`
+	SectionType       string `json:"section_type"`
+	ProfName          string `json:"prof_name"`
+	OpenSeats         int    `json:"open_seats"`
+	Capacity          int    `json:"capacity"`
+	WaitlistOpenSpots int    `json:"waitlist_open_spots"`
+	WaitlistCapacity  int    `json:"waitlist_capacity"`
+}
+
+// queueSearchAlerts Queues alerts for saved searches that have matched at least one section with
+// an open seat for long enough (see DebounceObservations and DebounceDuration), one outbox entry
+// per search listing its matching sections (up to maxSearchResults, best first). Searches that
+// are still settling have their match streak saved, and searches that no longer match have it
+// reset. Searches that fire are removed in the same statement so they can't be queued twice.
+// Returns number of searches that fired or error if queueing fails
+func queueSearchAlerts(ctx context.Context, pool DB, term int) (int64, error) {
+
+	// catalog number is the trailing number of the course name (e.g. COMP SCI 400), a search's
+	// streak only counts a scrape once one of its sections has been updated since it was last seen
+	var fired int64
+	err := pool.QueryRow(ctx, `
+		WITH matches AS (
+			SELECT sa.id AS search_id,
+			       sa.user_id,
+			       u.email,
+			       cs.course_id,
+			       cs.course_name,
+			       cs.section_num,
+			       cs.section_type,
+			       cs.prof_name,
+			       cs.capacity,
+			       cs.open_seats,
+			       cs.waitlist_open_spots,
+			       cs.waitlist_capacity,
+			       cs.last_updated,
+			       row_number() OVER (
+			           PARTITION BY sa.id ORDER BY cs.open_seats DESC, cs.course_name, cs.section_num
+			       ) AS rank
+			FROM search_alerts sa
+			JOIN users u ON u.id = sa.user_id
+			JOIN course_sections cs ON cs.term = sa.term
+			WHERE sa.term = $1
+			  AND COALESCE(u.email, '') <> ''
+			  AND cs.open_seats > 0
+			  AND (sa.subject_id   IS NULL OR cs.subject_id::int = sa.subject_id)
+			  AND (sa.section_type IS NULL OR cs.section_type = sa.section_type)
+			  AND (sa.catalog_min  IS NULL OR substring(cs.course_name from '([0-9]+)[A-Za-z]*$')::int >= sa.catalog_min)
+			  AND (sa.catalog_max  IS NULL OR substring(cs.course_name from '([0-9]+)[A-Za-z]*$')::int <= sa.catalog_max)
+			  AND (cardinality(sa.breadth_codes) = 0 OR EXISTS (
+				SELECT 1
+				FROM course_breadths cb
+				WHERE cb.course_id = cs.course_id
+				  AND cb.term      = cs.term
+				  AND cb.breadth_code = ANY(sa.breadth_codes)
+			  ))
+		),
+		streaks AS (
+			SELECT sa.id,
+			       CASE WHEN sa.matched_since IS NULL THEN 1
+			            ELSE sa.match_observations + (m.observed_at > sa.observed_at)::int
+			       END AS observations,
+			       COALESCE(sa.matched_since, m.observed_at) AS matched_since,
+			       GREATEST(m.observed_at, sa.observed_at) AS observed_at
+			FROM search_alerts sa
+			JOIN (
+				SELECT search_id, max(last_updated) AS observed_at FROM matches GROUP BY search_id
+			) m ON m.search_id = sa.id
+		),
+		settled AS (
+			SELECT id
+			FROM streaks
+			WHERE ($3::int <= 0 AND $4::float8 <= 0)
+			   OR ($3::int > 0 AND observations >= $3::int)
+			   OR ($4::float8 > 0 AND $5::timestamptz - matched_since >= $4::float8 * INTERVAL '1 second')
+		),
+		waiting AS (
+			UPDATE search_alerts sa
+			SET match_observations = s.observations,
+			    matched_since      = s.matched_since,
+			    observed_at        = s.observed_at
+			FROM streaks s
+			WHERE sa.id = s.id
+			  AND s.id NOT IN (SELECT id FROM settled)
+		),
+		reset AS (
+			UPDATE search_alerts sa
+			SET match_observations = 0, matched_since = NULL, observed_at = NULL
+			WHERE sa.term = $1
+			  AND sa.matched_since IS NOT NULL
+			  AND sa.id NOT IN (SELECT id FROM streaks)
+		),
+		removed AS (
+			DELETE FROM search_alerts WHERE id IN (SELECT id FROM settled)
+			RETURNING id
+		),
+		queued AS (
+			INSERT INTO notification_outbox (
+				idempotency_key, user_id, email, term, course_id, course_name, section_num,
+				alert_type, open_seats, waitlist_open_spots, waitlist_capacity, section_type, capacity,
+				prof_name, search_id, search_results
+			)
+			SELECT gen_random_uuid()::text, m.user_id, m.email, $1, m.course_id, m.course_name,
+			       m.section_num, 'search', m.open_seats, m.waitlist_open_spots, m.waitlist_capacity,
+			       m.section_type, m.capacity, m.prof_name, m.search_id,
+			       (
+			           SELECT jsonb_agg(jsonb_build_object(
+			                      'course_id', r.course_id, 'course_name', r.course_name,
+			                      'section_num', r.section_num, 'section_type', r.section_type,
+			                      'prof_name', r.prof_name, 'open_seats', r.open_seats,
+			                      'capacity', r.capacity, 'waitlist_open_spots', r.waitlist_open_spots,
+			                      'waitlist_capacity', r.waitlist_capacity
+			                  ) ORDER BY r.rank)
+			           FROM matches r
+			           WHERE r.search_id = m.search_id AND r.rank <= $2
+			       )
+			FROM matches m
+			JOIN removed ON removed.id = m.search_id
+			WHERE m.rank = 1
+			RETURNING search_id
+		)
+		SELECT count(*) FROM queued;
+	`, term, maxSearchResults, DebounceObservations, DebounceDuration.Seconds(), time.Now()).Scan(&fired)
+	if err != nil {
+		return 0, fmt.Errorf("Error with queueing search alerts: %w", err)
+	}
+
+	return fired, nil
+}
@@ -0,0 +1,310 @@
+package enrollalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// re-fetch each alert's section right before it's sent and drop or re-queue alerts whose section
+// no longer matches (seat info in the DB can be minutes old by the time alerts go out)
+var RecheckSeats bool
+
+const (
+	recheckWorkers = 5
+
+	// how long a stale entry waits before being checked again, and how old it can get before
+	// it's dropped instead
+	recheckRetryDelay = 5 * time.Minute
+	recheckMaxAge     = 1 * time.Hour
+)
+
+// fetchCurrentSections Re-fetches section info from the enrollment API for given courses.
+// Returns sections keyed by course ID then section number, courses that couldn't be fetched are left out
+func fetchCurrentSections(pool DB, courseIDs []string) (map[string]map[string]*Section, error) {
+
+	courseCodes, err := getCourseCodesFromDB(pool, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var waitGroup sync.WaitGroup
+	var mutex     sync.Mutex
+	sections := make(map[string]map[string]*Section)
+
+	jobs := make(chan *CourseCodes, len(courseCodes))
+	for range min(recheckWorkers, len(courseCodes)) {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for courseCode := range jobs {
+
+				enrollmentPackages, err := getSectionInfo(courseCode)
+				if err != nil {
+					log.Printf("Error re-checking section info for %s: %v", courseCode.CourseID, err)
+					continue
+				}
+
+				// sections can be shared between packages, any copy has the same seat info
+				courseSections := make(map[string]*Section)
+				for _, enrollmentPackage := range enrollmentPackages {
+					for i := range enrollmentPackage.Sections {
+						section := &enrollmentPackage.Sections[i]
+						courseSections[section.SectionNumber] = section
+					}
+				}
+
+				mutex.Lock()
+				sections[courseCode.CourseID] = courseSections
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, courseCode := range courseCodes {
+		jobs <- courseCode
+	}
+	close(jobs)
+	waitGroup.Wait()
+
+	return sections, nil
+}
+
+// dropStaleEntry Marks entry as failed because its section no longer matches so it's never sent,
+// and releases the other alerts in its alert's group.
+// Returns error if entry or group can't be updated
+func dropStaleEntry(ctx context.Context, tx pgx.Tx, entry *outboxEntry) error {
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE notification_outbox
+		SET status = 'failed', last_error = 'Section no longer matches alert'
+		WHERE id = $1;
+	`, entry.id); err != nil {
+		return fmt.Errorf("Error dropping stale outbox entry %d: %w", entry.id, err)
+	}
+
+	// the alert's group can fire again since this one won't be sent
+	if entry.groupID != 0 {
+		return releaseGroupAlternatives(ctx, tx, entry.groupID, entry.alertID)
+	}
+
+	return nil
+}
+
+// restoreStaleAlert Puts back the alert a dropped stale entry was queued for, so it fires the next
+// time its section matches. Kept alerts are re-armed with the fire undone. Removed alerts are
+// re-inserted as they were before they fired, with their chat webhooks re-attached. An alert the
+// DB won't take back (the user has since saved it again, reached their alert limit or been deleted,
+// the section is no longer in the term or the alert has expired) is logged and left out.
+// Returns error if alert can't be re-armed or its chat webhooks can't be re-attached
+func restoreStaleAlert(ctx context.Context, tx pgx.Tx, entry *outboxEntry) error {
+
+	if entry.alertKept {
+		if _, err := tx.Exec(ctx, `
+			UPDATE user_courses
+			SET armed         = true,
+			    last_matched  = false,
+			    fire_count    = GREATEST(fire_count - 1, 0),
+			    last_fired_at = NULL
+			WHERE id = $1;
+		`, entry.alertID); err != nil {
+			return fmt.Errorf("Error re-arming alert %d: %w", entry.alertID, err)
+		}
+		return nil
+	}
+
+	if entry.alertSnapshot == nil {
+		return nil
+	}
+
+	// savepoint so an alert the DB refuses doesn't abort the entry being dropped
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Error starting alert restore savepoint: %w", err)
+	}
+	defer savepoint.Rollback(ctx)
+
+	var alertID int64
+	err = savepoint.QueryRow(ctx, `
+		INSERT INTO user_courses
+		SELECT * FROM jsonb_populate_record(NULL::user_courses, $1::jsonb)
+		ON CONFLICT DO NOTHING
+		RETURNING id;
+	`, entry.alertSnapshot).Scan(&alertID)
+
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		log.Printf("Not restoring alert for %s %s, user %d already has it", entry.courseName, entry.sectionNum, entry.userID)
+		return nil
+	case errors.As(err, &pgErr) && pgErr.ConstraintName == "user_courses_quota":
+		log.Printf("Not restoring alert for %s %s, user %d is at their alert limit", entry.courseName, entry.sectionNum, entry.userID)
+		return nil
+	case err != nil:
+		log.Printf("Not restoring alert for %s %s for user %d: %v", entry.courseName, entry.sectionNum, entry.userID, err)
+		return nil
+	}
+
+	// chat webhooks the user has deleted since stay deleted
+	if _, err := savepoint.Exec(ctx, `
+		INSERT INTO alert_chat_webhooks (chat_webhook_id, alert_id)
+		SELECT cw.id, $2
+		FROM chat_webhooks cw
+		WHERE cw.id = ANY($1) AND cw.user_id = $3
+		ON CONFLICT DO NOTHING;
+	`, entry.chatWebhookIDs, alertID, entry.userID); err != nil {
+		return fmt.Errorf("Error re-attaching chat webhooks to alert %d: %w", alertID, err)
+	}
+
+	if err := savepoint.Commit(ctx); err != nil {
+		return fmt.Errorf("Error releasing alert restore savepoint: %w", err)
+	}
+
+	return nil
+}
+
+// dropStaleAlert Drops a stale entry and puts its alert back in one transaction, so an alert is
+// never restored for an entry that's still queued or lost for one that's dropped.
+// Returns error if entry can't be dropped or alert can't be restored
+func dropStaleAlert(ctx context.Context, pool *pgxpool.Pool, entry *outboxEntry) error {
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Error starting stale entry transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := restoreStaleAlert(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := dropStaleEntry(ctx, tx, entry); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Error committing stale entry transaction: %w", err)
+	}
+
+	return nil
+}
+
+// recheckAlert Builds an alert from entry with the section's re-fetched info so it can be matched
+// again, nil section meaning the section is gone from the course.
+// Returns alert
+func recheckAlert(entry *outboxEntry, section *Section) *alertRow {
+
+	alert := &alertRow{
+		courseID:      entry.courseID,
+		sectionNum:    entry.sectionNum,
+		alertType:     entry.alertType,
+		seatThreshold: entry.seatThreshold,
+	}
+	if entry.expression != "" {
+		alert.expression = &entry.expression
+	}
+
+	if section != nil {
+		alert.openSeats = section.EnrollmentStatus.OpenSeats
+		alert.waitlistOpenSpots = section.EnrollmentStatus.WaitlistOpenSpots
+		alert.section = sectionFields{
+			CourseName:       entry.courseName,
+			SectionType:      section.ClassType,
+			SubjectID:        section.Subject.SubjectID,
+			ProfName:         fmt.Sprintf("%s %s", section.Professor.Name.First, section.Professor.Name.Last),
+			Capacity:         section.EnrollmentStatus.Capacity,
+			Enrolled:         section.EnrollmentStatus.CurrentlyEnrolled,
+			WaitlistCapacity: section.EnrollmentStatus.WaitlistCapacity,
+		}
+	}
+
+	return alert
+}
+
+// recheckEntries Re-fetches seat info for each entry's section and checks the alert (including
+// expression alerts) still matches before it's sent. Stale entries for kept alerts are dropped and
+// the alert is re-armed, since it will fire again the next time its section opens. Other stale
+// entries are re-queued to be checked again later, and once they're older than recheckMaxAge
+// they're dropped and their alert is put back. Entries that were already sent through a channel,
+// aren't for a single section, or whose course couldn't be fetched are sent as matched.
+// Returns entries that should still be sent with their seat info updated, or error if an entry
+// can't be updated
+func recheckEntries(ctx context.Context, pool *pgxpool.Pool, entries []*outboxEntry, now time.Time) ([]*outboxEntry, error) {
+
+	var checked []*outboxEntry
+	var courseIDs []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		switch entry.alertType {
+		case "any", "threshold", "waitlist", "expression":
+		default:
+			continue
+		}
+		if len(entry.channelsSent) > 0 {
+			continue
+		}
+
+		checked = append(checked, entry)
+		if !seen[entry.courseID] {
+			seen[entry.courseID] = true
+			courseIDs = append(courseIDs, entry.courseID)
+		}
+	}
+
+	if len(checked) == 0 {
+		return entries, nil
+	}
+
+	sections, err := fetchCurrentSections(pool, courseIDs)
+	if err != nil {
+		log.Printf("Error re-checking seat info, sending alerts as matched: %v", err)
+		return entries, nil
+	}
+
+	stale := make(map[int64]bool)
+	for _, entry := range checked {
+		courseSections, fetched := sections[entry.courseID]
+		if !fetched {
+			continue
+		}
+
+		// a section that's gone from the course can't match anymore
+		section := courseSections[entry.sectionNum]
+		alert := recheckAlert(entry, section)
+		if section != nil && alert.matches() {
+			entry.openSeats = alert.openSeats
+			entry.waitlistOpenSpots = alert.waitlistOpenSpots
+			continue
+		}
+
+		stale[entry.id] = true
+		if entry.alertKept || now.Sub(entry.createdAt) >= recheckMaxAge {
+			log.Printf("Dropping stale %s alert %s for %s %s (matched %d open seats, now %d)",
+				entry.alertType, entry.idempotencyKey, entry.courseName, entry.sectionNum, entry.openSeats, alert.openSeats)
+			if err := dropStaleAlert(ctx, pool, entry); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		log.Printf("Re-queueing stale %s alert %s for %s %s (matched %d open seats, now %d)",
+			entry.alertType, entry.idempotencyKey, entry.courseName, entry.sectionNum, entry.openSeats, alert.openSeats)
+		if err := deferOutboxEntry(ctx, pool, entry, now.Add(recheckRetryDelay)); err != nil {
+			return nil, err
+		}
+	}
+
+	var ready []*outboxEntry
+	for _, entry := range entries {
+		if !stale[entry.id] {
+			ready = append(ready, entry)
+		}
+	}
+
+	return ready, nil
+}
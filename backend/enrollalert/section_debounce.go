@@ -0,0 +1,140 @@
+package enrollalert
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"github.com/jackc/pgx/v5"
+)
+
+// how long a section must keep matching an alert's condition before the alert fires, so sections
+// flipping between open and closed as students swap don't set off bursts of alerts. A match
+// counts once it has been seen for DebounceObservations scrapes in a row or has lasted
+// DebounceDuration, whichever comes first. Both 0 (default) fires alerts on the first match.
+var (
+	DebounceObservations int
+	DebounceDuration     time.Duration
+)
+
+// stored match state for an alert condition on a section
+type sectionMatch struct {
+	observations int
+	matchedSince time.Time
+}
+
+// condition Returns key for the alert's condition so alerts with the same condition on a section
+// share match state
+func (alert *alertRow) condition() string {
+	if alert.alertType == "threshold" && alert.seatThreshold != nil {
+		return fmt.Sprintf("threshold:%d", *alert.seatThreshold)
+	}
+	if alert.alertType == "expression" && alert.expression != nil {
+		return "expression:" + *alert.expression
+	}
+	return alert.alertType
+}
+
+// settled Returns whether a condition that has matched for given number of scrapes since
+// matchedSince has matched long enough for alerts to fire
+func (match sectionMatch) settled(now time.Time) bool {
+	if DebounceObservations <= 0 && DebounceDuration <= 0 {
+		return true
+	}
+	return (DebounceObservations > 0 && match.observations >= DebounceObservations) ||
+		(DebounceDuration > 0 && now.Sub(match.matchedSince) >= DebounceDuration)
+}
+
+// updateMatchState Records which alert conditions match each alert's section in the latest scrape.
+// A condition's observation count only goes up when its section has been scraped again since it
+// was last recorded. Conditions on the alerts' sections that no longer match are removed, along
+// with state for sections that no longer have alerts.
+// Marks alerts whose condition matches but hasn't settled yet as unsettled. Does nothing when
+// debouncing is off.
+// Returns error if match state can't be updated
+func updateMatchState(ctx context.Context, tx pgx.Tx, term int, alerts []*alertRow, now time.Time) error {
+
+	if DebounceObservations <= 0 && DebounceDuration <= 0 {
+		return nil
+	}
+
+	// one row per section condition, alerts sharing a condition would otherwise conflict
+	var courseIDs, sectionNums, conditions []string
+	var observedAt []time.Time
+	var checkedCourseIDs, checkedSectionNums []string
+	seen := make(map[string]bool)
+	for _, alert := range alerts {
+		checkedCourseIDs = append(checkedCourseIDs, alert.courseID)
+		checkedSectionNums = append(checkedSectionNums, alert.sectionNum)
+
+		key := alert.courseID + "-" + alert.sectionNum + "-" + alert.condition()
+		if !alert.matches() || seen[key] {
+			continue
+		}
+		seen[key] = true
+		courseIDs = append(courseIDs, alert.courseID)
+		sectionNums = append(sectionNums, alert.sectionNum)
+		conditions = append(conditions, alert.condition())
+		observedAt = append(observedAt, alert.observedAt)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM section_match_state s
+		WHERE s.term = $1
+		  AND NOT EXISTS (
+			SELECT 1
+			FROM unnest($2::text[], $3::text[], $4::text[]) AS m (course_id, section_num, condition)
+			WHERE m.course_id = s.course_id AND m.section_num = s.section_num AND m.condition = s.condition
+		  )
+		  AND (
+			EXISTS (
+				SELECT 1
+				FROM unnest($5::text[], $6::text[]) AS c (course_id, section_num)
+				WHERE c.course_id = s.course_id AND c.section_num = s.section_num
+			)
+			OR NOT EXISTS (
+				SELECT 1 FROM user_courses uc
+				WHERE uc.course_id = s.course_id AND uc.section_num = s.section_num
+			)
+		  );
+	`, term, courseIDs, sectionNums, conditions, checkedCourseIDs, checkedSectionNums); err != nil {
+		return fmt.Errorf("Error with clearing section match state: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		INSERT INTO section_match_state (term, course_id, section_num, condition, observations, matched_since, observed_at)
+		SELECT $1, m.course_id, m.section_num, m.condition, 1, m.observed_at, m.observed_at
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::timestamptz[])
+		     AS m (course_id, section_num, condition, observed_at)
+		ON CONFLICT (term, course_id, section_num, condition)
+		DO UPDATE SET
+			observations = section_match_state.observations +
+			               (EXCLUDED.observed_at > section_match_state.observed_at)::int,
+			observed_at  = GREATEST(EXCLUDED.observed_at, section_match_state.observed_at)
+		RETURNING course_id, section_num, condition, observations, matched_since;
+	`, term, courseIDs, sectionNums, conditions, observedAt)
+	if err != nil {
+		return fmt.Errorf("Error with updating section match state: %w", err)
+	}
+	defer rows.Close()
+
+	matches := make(map[string]sectionMatch)
+	for rows.Next() {
+		var courseID, sectionNum, condition string
+		var match sectionMatch
+		if err := rows.Scan(&courseID, &sectionNum, &condition, &match.observations, &match.matchedSince); err != nil {
+			return fmt.Errorf("Error with section match state row scan: %w", err)
+		}
+		matches[courseID + "-" + sectionNum + "-" + condition] = match
+	}
+
+	if rows.Err() != nil {
+		return fmt.Errorf("Error with section match state iteration: %w", rows.Err())
+	}
+
+	for _, alert := range alerts {
+		match, ok := matches[alert.courseID + "-" + alert.sectionNum + "-" + alert.condition()]
+		alert.unsettled = ok && !match.settled(now)
+	}
+
+	return nil
+}
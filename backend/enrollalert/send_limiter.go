@@ -0,0 +1,57 @@
+package enrollalert
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sendLimiter spaces sends out so they stay under a maximum rate, shared by every worker
+type sendLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newSendLimiter creates limiter allowing given number of sends per second, or any number if
+// rate isn't positive
+func newSendLimiter(rate float64) *sendLimiter {
+	if rate <= 0 {
+		return &sendLimiter{}
+	}
+	return &sendLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait Reserves count sends and blocks until the last of them can go out, so sends made together
+// (e.g. a bulk request) don't go over the rate.
+// Returns error if context is cancelled while waiting
+func (l *sendLimiter) wait(ctx context.Context, count int) error {
+
+	if l == nil || l.interval == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	last := l.next.Add(time.Duration(max(count-1, 0)) * l.interval)
+	l.next = last.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(last)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,221 @@
+package enrollalert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const sesEventMaxBody = 256 * 1024
+
+// structure of SES bounce and complaint notifications (and configuration set events, which use
+// eventType instead of notificationType)
+type sesEvent struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+
+	Mail struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// kind Returns type of SES event, whichever of notificationType or eventType is set
+func (e *sesEvent) kind() string {
+	if e.NotificationType != "" {
+		return e.NotificationType
+	}
+	return e.EventType
+}
+
+// SESEventHandler receives SES bounce and complaint events delivered by SNS and suppresses
+// the addresses they're for
+type SESEventHandler struct {
+	pool     *pgxpool.Pool
+	verifier *SNSVerifier
+
+	// topics messages are accepted from, any topic if empty
+	topicARNs []string
+}
+
+// NewSESEventHandler creates HTTP handler for an SNS subscription to SES events
+func NewSESEventHandler(pool *pgxpool.Pool, verifier *SNSVerifier, topicARNs ...string) *SESEventHandler {
+	return &SESEventHandler{pool: pool, verifier: verifier, topicARNs: topicARNs}
+}
+
+// ServeHTTP Verifies SNS message, confirms subscriptions and processes SES event notifications.
+// Responds with non 2xx status if message should be redelivered by SNS
+func (h *SESEventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, sesEventMaxBody))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	// SNS sends JSON with a text/plain content type
+	var message snsMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		http.Error(w, "invalid SNS message", http.StatusBadRequest)
+		return
+	}
+
+	if len(h.topicARNs) > 0 && !slices.Contains(h.topicARNs, message.TopicARN) {
+		log.Printf("Rejected SNS message %s from unexpected topic %s", message.MessageID, message.TopicARN)
+		http.Error(w, "unexpected topic", http.StatusForbidden)
+		return
+	}
+
+	if err := h.verifier.verify(&message); err != nil {
+		log.Printf("Rejected SNS message %s: %v", message.MessageID, err)
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		if err := h.verifier.confirmSubscription(&message); err != nil {
+			log.Println(err)
+			http.Error(w, "error confirming subscription", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Confirmed SNS subscription to %s", message.TopicARN)
+
+	case "UnsubscribeConfirmation":
+		log.Printf("Unsubscribed from SNS topic %s", message.TopicARN)
+
+	case "Notification":
+		if err := h.processEvent(r.Context(), message.Message); err != nil {
+			log.Printf("Error processing SNS message %s: %v", message.MessageID, err)
+			http.Error(w, "error processing event", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// processEvent Suppresses recipients of permanent bounces and complaints. Transient bounces
+// (full mailbox, etc.) and other event types are ignored.
+// Returns error if event can't be parsed or users can't be updated
+func (h *SESEventHandler) processEvent(ctx context.Context, raw string) error {
+
+	var event sesEvent
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return fmt.Errorf("Error with SES event unmarshal: %w", err)
+	}
+
+	var status, feedback, detail string
+	var emails []string
+	switch event.kind() {
+	case "Bounce":
+		if event.Bounce.BounceType != "Permanent" {
+			log.Printf("Ignoring %s bounce for message %s", event.Bounce.BounceType, event.Mail.MessageID)
+			return nil
+		}
+		status, feedback = "bounced", "bounce"
+		detail = event.Bounce.BounceType + "/" + event.Bounce.BounceSubType
+		for _, recipient := range event.Bounce.BouncedRecipients {
+			emails = append(emails, recipient.EmailAddress)
+			if recipient.DiagnosticCode != "" {
+				detail += ": " + recipient.DiagnosticCode
+			}
+		}
+
+	case "Complaint":
+		status, feedback = "complained", "complaint"
+		detail = event.Complaint.ComplaintFeedbackType
+		for _, recipient := range event.Complaint.ComplainedRecipients {
+			emails = append(emails, recipient.EmailAddress)
+		}
+
+	default:
+		return nil
+	}
+
+	suppressed, err := SuppressEmails(ctx, h.pool, emails, status, detail)
+	if err != nil {
+		return err
+	}
+	log.Printf("Suppressed %d users (%s) for message %s", suppressed, status, event.Mail.MessageID)
+
+	// link event back to notification it was for
+	if event.Mail.MessageID != "" {
+		if _, err := h.pool.Exec(ctx, `
+			UPDATE notifications
+			SET feedback = $2, feedback_at = CURRENT_TIMESTAMP
+			WHERE provider_message_id = $1;
+		`, event.Mail.MessageID, feedback); err != nil {
+			return fmt.Errorf("Error recording %s for message %s: %w", feedback, event.Mail.MessageID, err)
+		}
+	}
+
+	return nil
+}
+
+// SuppressEmails Marks users with given email addresses as bounced or complained so they're
+// skipped when matching and sending alerts. A complaint is never downgraded to a bounce.
+// Returns number of users updated or error if update fails
+func SuppressEmails(ctx context.Context, pool *pgxpool.Pool, emails []string, status string, detail string) (int64, error) {
+
+	var lowered []string
+	for _, email := range emails {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(email)))
+	}
+
+	tag, err := pool.Exec(ctx, `
+		UPDATE users
+		SET email_status        = $2,
+		    email_status_detail = $3,
+		    email_status_at     = CURRENT_TIMESTAMP
+		WHERE lower(email) = ANY($1)
+		  AND (email_status = 'ok' OR $2 = 'complained');
+	`, lowered, status, detail)
+	if err != nil {
+		return 0, fmt.Errorf("Error suppressing emails: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// ClearEmailSuppression Sets user's email status back to ok once their address is fixed.
+// Returns error if update fails
+func ClearEmailSuppression(ctx context.Context, pool *pgxpool.Pool, userID int) error {
+
+	_, err := pool.Exec(ctx, `
+		UPDATE users
+		SET email_status = 'ok', email_status_detail = NULL, email_status_at = CURRENT_TIMESTAMP
+		WHERE id = $1;
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("Error clearing email suppression for user %d: %w", userID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package enrollalert
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const snsTimeout = 10 * time.Second
+
+// signing certificates and subscribe URLs must come from an SNS endpoint
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// structure of message SNS POSTs to HTTP subscriptions
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicARN         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// stringToSign Builds the canonical string SNS signs for the message's type.
+// Returns string to sign or error if message type isn't known
+func (m *snsMessage) stringToSign() (string, error) {
+
+	var fields [][2]string
+	switch m.Type {
+	case "Notification":
+		fields = [][2]string{{"Message", m.Message}, {"MessageId", m.MessageID}}
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", m.Timestamp}, [2]string{"TopicArn", m.TopicARN},
+			[2]string{"Type", m.Type})
+
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = [][2]string{
+			{"Message", m.Message}, {"MessageId", m.MessageID}, {"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp}, {"Token", m.Token}, {"TopicArn", m.TopicARN}, {"Type", m.Type},
+		}
+
+	default:
+		return "", fmt.Errorf("Unknown SNS message type %q", m.Type)
+	}
+
+	var builder strings.Builder
+	for _, field := range fields {
+		builder.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+
+	return builder.String(), nil
+}
+
+// SNSVerifier checks SNS message signatures against the topic's signing certificate
+type SNSVerifier struct {
+	client *http.Client
+
+	// returns whether a signing certificate or subscribe URL can be trusted
+	allowURL func(*url.URL) bool
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// NewSNSVerifier creates verifier that only trusts certificates served by SNS over HTTPS
+func NewSNSVerifier() *SNSVerifier {
+	return &SNSVerifier{
+		client:   &http.Client{Timeout: snsTimeout},
+		allowURL: isSNSURL,
+		certs:    make(map[string]*x509.Certificate),
+	}
+}
+
+// NewLocalSNSVerifier creates verifier that also trusts certificates served from localhost,
+// so sample payloads signed by a local stand-in can be posted during development
+func NewLocalSNSVerifier() *SNSVerifier {
+	verifier := NewSNSVerifier()
+	verifier.allowURL = func(u *url.URL) bool {
+		host := u.Hostname()
+		return isSNSURL(u) || host == "localhost" || host == "127.0.0.1"
+	}
+	return verifier
+}
+
+// isSNSURL Returns whether URL is an HTTPS URL on an SNS endpoint
+func isSNSURL(u *url.URL) bool {
+	return u.Scheme == "https" && snsHostPattern.MatchString(u.Hostname())
+}
+
+// checkURL Parses URL given in an SNS message and makes sure it can be trusted.
+// Returns parsed URL or error if URL isn't trusted
+func (v *SNSVerifier) checkURL(raw string) (*url.URL, error) {
+
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SNS URL: %w", err)
+	}
+	if !v.allowURL(parsed) {
+		return nil, fmt.Errorf("Untrusted SNS URL %q", raw)
+	}
+
+	return parsed, nil
+}
+
+// getCertificate Downloads and parses signing certificate, caching it so it's only fetched once.
+// Returns certificate or error if it can't be downloaded or parsed
+func (v *SNSVerifier) getCertificate(certURL string) (*x509.Certificate, error) {
+
+	v.mu.Lock()
+	cert, ok := v.certs[certURL]
+	v.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	parsed, err := v.checkURL(certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := v.client.Get(parsed.String())
+	if err != nil {
+		return nil, fmt.Errorf("Error downloading SNS signing certificate: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SNS signing certificate responded with status %d", response.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SNS signing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("SNS signing certificate isn't PEM encoded")
+	}
+
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing SNS signing certificate: %w", err)
+	}
+
+	v.mu.Lock()
+	v.certs[certURL] = cert
+	v.mu.Unlock()
+
+	return cert, nil
+}
+
+// verify Checks message signature using the signing certificate it references.
+// Returns error if signature is missing, invalid or signed by an untrusted certificate
+func (v *SNSVerifier) verify(m *snsMessage) error {
+
+	var algorithm x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		algorithm = x509.SHA1WithRSA
+	case "2":
+		algorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("Unsupported SNS signature version %q", m.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("Error decoding SNS signature: %w", err)
+	}
+
+	toSign, err := m.stringToSign()
+	if err != nil {
+		return err
+	}
+
+	cert, err := v.getCertificate(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	if err := cert.CheckSignature(algorithm, []byte(toSign), signature); err != nil {
+		return fmt.Errorf("Invalid SNS signature: %w", err)
+	}
+
+	return nil
+}
+
+// confirmSubscription Visits subscription confirmation URL so SNS starts delivering to us.
+// Returns error if URL isn't trusted or request fails
+func (v *SNSVerifier) confirmSubscription(m *snsMessage) error {
+
+	parsed, err := v.checkURL(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+
+	response, err := v.client.Get(parsed.String())
+	if err != nil {
+		return fmt.Errorf("Error confirming SNS subscription: %w", err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("SNS subscription confirmation responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package enrollalert
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// how long links in an email keep working
+	unsubscribeAlertTTL = 90 * 24 * time.Hour
+	unsubscribeUserTTL  = 365 * 24 * time.Hour
+)
+
+var (
+	errInvalidToken = errors.New("invalid unsubscribe token")
+	errExpiredToken = errors.New("unsubscribe token expired")
+)
+
+// what an unsubscribe token lets its holder do
+type unsubscribeToken struct {
+	kind    string // "alert" cancels one alert, "user" stops all alert emails
+	userID  int
+	alertID int64
+	expires time.Time
+}
+
+// UnsubscribeLinks creates and verifies signed unsubscribe links
+type UnsubscribeLinks struct {
+	secret  []byte
+	baseURL string
+}
+
+// NewUnsubscribeLinks creates link signer for the unsubscribe handler served at baseURL
+func NewUnsubscribeLinks(secret string, baseURL string) (*UnsubscribeLinks, error) {
+
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("Unsubscribe secret must be at least 32 characters")
+	}
+	if _, err := url.Parse(baseURL); err != nil || baseURL == "" {
+		return nil, fmt.Errorf("Invalid unsubscribe URL %q", baseURL)
+	}
+
+	return &UnsubscribeLinks{secret: []byte(secret), baseURL: baseURL}, nil
+}
+
+// sign Returns HMAC-SHA256 of token payload
+func (l *UnsubscribeLinks) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// encode Returns signed token string of the form <payload>.<signature>
+func (l *UnsubscribeLinks) encode(token unsubscribeToken) string {
+	payload := fmt.Sprintf("%s:%d:%d:%d", token.kind, token.userID, token.alertID, token.expires.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(l.sign(payload))
+}
+
+// decode Verifies token signature and expiry.
+// Returns token or error if token is malformed, forged or expired
+func (l *UnsubscribeLinks) decode(raw string, now time.Time) (unsubscribeToken, error) {
+
+	var token unsubscribeToken
+
+	encodedPayload, encodedSignature, ok := strings.Cut(raw, ".")
+	if !ok {
+		return token, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return token, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, l.sign(string(payload))) {
+		return token, errInvalidToken
+	}
+
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 4 || (fields[0] != "alert" && fields[0] != "user") {
+		return token, errInvalidToken
+	}
+
+	token.kind = fields[0]
+	userID, err1 := strconv.Atoi(fields[1])
+	alertID, err2 := strconv.ParseInt(fields[2], 10, 64)
+	expires, err3 := strconv.ParseInt(fields[3], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return token, errInvalidToken
+	}
+	token.userID, token.alertID, token.expires = userID, alertID, time.Unix(expires, 0)
+
+	if !now.Before(token.expires) {
+		return token, errExpiredToken
+	}
+
+	return token, nil
+}
+
+// link Returns unsubscribe URL carrying given token
+func (l *UnsubscribeLinks) link(token unsubscribeToken) string {
+	separator := "?"
+	if strings.Contains(l.baseURL, "?") {
+		separator = "&"
+	}
+	return l.baseURL + separator + "token=" + url.QueryEscape(l.encode(token))
+}
+
+// AlertURL Returns link that cancels one of the user's alerts
+func (l *UnsubscribeLinks) AlertURL(userID int, alertID int64) string {
+	return l.link(unsubscribeToken{
+		kind: "alert", userID: userID, alertID: alertID, expires: time.Now().Add(unsubscribeAlertTTL),
+	})
+}
+
+// UserURL Returns link that stops all alert emails to the user
+func (l *UnsubscribeLinks) UserURL(userID int) string {
+	return l.link(unsubscribeToken{kind: "user", userID: userID, expires: time.Now().Add(unsubscribeUserTTL)})
+}
+
+// unsubscribe Cancels alert or opts user out of alert emails, depending on token kind.
+// Returns description of what was done or error if update fails
+func unsubscribe(ctx context.Context, pool *pgxpool.Pool, token unsubscribeToken) (string, error) {
+
+	if token.kind == "alert" {
+		if _, err := pool.Exec(ctx, `
+			DELETE FROM user_courses WHERE id = $1 AND user_id = $2;
+		`, token.alertID, token.userID); err != nil {
+			return "", fmt.Errorf("Error cancelling alert %d: %w", token.alertID, err)
+		}
+		return "Your alert has been cancelled.", nil
+	}
+
+	if _, err := pool.Exec(ctx, `
+		UPDATE users
+		SET email_status = 'unsubscribed', email_status_detail = 'unsubscribe link',
+		    email_status_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND email_status = 'ok';
+	`, token.userID); err != nil {
+		return "", fmt.Errorf("Error unsubscribing user %d: %w", token.userID, err)
+	}
+
+	return "You've been unsubscribed and won't get any more alert emails.", nil
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="UTF-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>EnrollAlert</title></head>
+<body style="font-family:Arial,sans-serif;color:#1f2937;max-width:480px;margin:48px auto;padding:0 16px;text-align:center;">
+{{if .Form}}<p>{{.Message}}</p>
+<form method="POST"><input type="hidden" name="token" value="{{.Token}}">
+<button type="submit" style="padding:12px 28px;font-size:16px;color:#fff;background:#2563eb;border:0;border-radius:4px;">Confirm</button>
+</form>{{else}}<p>{{.Message}}</p>{{end}}
+</body></html>`))
+
+// UnsubscribeHandler serves unsubscribe links. GET shows a confirmation page so link scanners
+// don't unsubscribe anyone, POST (the confirmation form or an RFC 8058 one-click request from
+// the mail client) does the unsubscribe.
+type UnsubscribeHandler struct {
+	pool  *pgxpool.Pool
+	links *UnsubscribeLinks
+}
+
+// NewUnsubscribeHandler creates HTTP handler for unsubscribe links
+func NewUnsubscribeHandler(pool *pgxpool.Pool, links *UnsubscribeLinks) *UnsubscribeHandler {
+	return &UnsubscribeHandler{pool: pool, links: links}
+}
+
+// ServeHTTP Verifies token and either asks for confirmation or unsubscribes
+func (h *UnsubscribeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// one-click requests carry the token in the URL, the confirmation form in the body
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	raw := r.Form.Get("token")
+
+	token, err := h.links.decode(raw, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		message := "This unsubscribe link isn't valid."
+		if errors.Is(err, errExpiredToken) {
+			message = "This unsubscribe link has expired. You can manage your alerts from My Courses."
+		}
+		unsubscribePage.Execute(w, map[string]interface{}{"Message": message})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		message := "Stop all EnrollAlert alert emails?"
+		if token.kind == "alert" {
+			message = "Cancel this alert?"
+		}
+		unsubscribePage.Execute(w, map[string]interface{}{"Form": true, "Message": message, "Token": raw})
+		return
+	}
+
+	message, err := unsubscribe(r.Context(), h.pool, token)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error unsubscribing", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Processed %s unsubscribe for user %d", token.kind, token.userID)
+	unsubscribePage.Execute(w, map[string]interface{}{"Message": message})
+}
@@ -0,0 +1,396 @@
+package enrollalert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	webhookMaxAttempts    = 3
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaxFailures    = 5
+	webhookTimeout        = 10 * time.Second
+)
+
+// structure of JSON body POSTed to user webhooks
+type webhookPayload struct {
+	Term       int    `json:"term"`
+	CourseID   string `json:"course_id"`
+	CourseName string `json:"course_name"`
+	SectionNum string `json:"section_num"`
+	AlertType  string `json:"alert_type"`
+	Expression string `json:"expression,omitempty"`
+	ClearedAlternatives []string `json:"cleared_alternatives,omitempty"`
+	OpenSeats  int    `json:"open_seats"`
+	SearchResults []SearchResult `json:"search_results,omitempty"`
+
+	// structure of waitlist section
+	Waitlist struct {
+		OpenSpots int `json:"open_spots"`
+		Capacity  int `json:"capacity"`
+	} `json:"waitlist"`
+
+	Timestamp string `json:"timestamp"`
+}
+
+// carrier-grade NAT range, used for internal addresses by some cloud networks
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+type userWebhook struct {
+	id     int64
+	url    string
+	secret string
+}
+
+type WebhookNotifier struct {
+	pool   *pgxpool.Pool
+	client *http.Client
+}
+
+// NewWebhookNotifier creates notifier that POSTs signed alert payloads to user webhooks
+func NewWebhookNotifier(pool *pgxpool.Pool) *WebhookNotifier {
+	return &WebhookNotifier{pool: pool, client: newPublicHTTPClient(webhookTimeout)}
+}
+
+// isPublicAddr Returns whether addr can be reached on the public internet, rejecting private,
+// loopback, link-local (e.g. the cloud metadata endpoint) and other internal addresses
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() && !addr.IsLoopback() &&
+		!addr.IsLinkLocalUnicast() && !sharedAddressSpace.Contains(addr)
+}
+
+// dialPublicOnly Rejects connections to internal addresses. Runs after DNS resolution so a
+// hostname can't be pointed at an internal address to get around the check.
+// Returns error if address isn't public
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("Refusing to connect to internal address %s", addr)
+	}
+
+	return nil
+}
+
+// newPublicHTTPClient Creates HTTP client for user supplied URLs that only connects to public
+// addresses over https, including when following redirects
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublicOnly}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if request.URL.Scheme != "https" {
+				return errors.New("Refusing to follow redirect to non-https URL")
+			}
+			if len(via) >= 5 {
+				return errors.New("Too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// requireHTTPS Checks that a user supplied URL is an absolute https URL.
+// Returns error if it isn't
+func requireHTTPS(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("Invalid URL: %w", err)
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return errors.New("URL must start with https://")
+	}
+	return nil
+}
+
+// Channel Returns name of webhook notification channel
+func (w *WebhookNotifier) Channel() string {
+	return "webhook"
+}
+
+// signWebhookPayload Computes HMAC-SHA256 signature over timestamp and body so receivers can
+// verify the payload came from us and reject replays.
+// Returns hex encoded signature
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getUserWebhooks Queries enabled webhooks for given user.
+// Returns list of webhooks or error if query fails
+func (w *WebhookNotifier) getUserWebhooks(ctx context.Context, userID int) ([]userWebhook, error) {
+
+	rows, err := w.pool.Query(ctx, `
+		SELECT id, url, secret
+		FROM user_webhooks
+		WHERE user_id = $1
+		  AND enabled;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error with webhook query: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []userWebhook
+	for rows.Next() {
+		var hook userWebhook
+		if err := rows.Scan(&hook.id, &hook.url, &hook.secret); err != nil {
+			return nil, fmt.Errorf("Error with webhook row scan: %w", err)
+		}
+		webhooks = append(webhooks, hook)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Error with webhook iteration: %w", rows.Err())
+	}
+
+	return webhooks, nil
+}
+
+// postWebhook Sends single signed POST request to webhook.
+// Returns whether the request can be retried and error if delivery failed
+func (w *WebhookNotifier) postWebhook(ctx context.Context, hook userWebhook, idempotencyKey string, body []byte) (bool, error) {
+
+	if err := requireHTTPS(hook.url); err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequestWithContext(ctx, "POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("Error while creating POST request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "EnrollAlert-Webhook/1.0")
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	request.Header.Set("X-EnrollAlert-Timestamp", timestamp)
+	request.Header.Set("X-EnrollAlert-Signature", "sha256="+signWebhookPayload(hook.secret, timestamp, body))
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, fmt.Errorf("Error sending request: %w", err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	// only retry on rate limiting and server side errors
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("Webhook responded with status %d", response.StatusCode)
+}
+
+// deliverWebhook Sends payload to webhook, retrying with exponential backoff. Every attempt
+// carries the same idempotency key so receivers can drop duplicates.
+// Returns error if every attempt fails
+func (w *WebhookNotifier) deliverWebhook(ctx context.Context, hook userWebhook, idempotencyKey string, body []byte) error {
+
+	backoff := webhookInitialBackoff
+
+	var err error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+
+		var retry bool
+		retry, err = w.postWebhook(ctx, hook, idempotencyKey, body)
+		if err == nil || !retry || attempt == webhookMaxAttempts {
+			break
+		}
+
+		log.Printf("Webhook %d attempt %d failed, retrying in %s: %v", hook.id, attempt, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return err
+}
+
+// recordWebhookResult Resets webhook failure count on success, otherwise increments it and
+// disables the webhook once it has failed too many times in a row.
+// Returns error if update fails
+func (w *WebhookNotifier) recordWebhookResult(ctx context.Context, hook userWebhook, deliveryErr error) error {
+
+	var err error
+	if deliveryErr == nil {
+		_, err = w.pool.Exec(ctx, `
+			UPDATE user_webhooks
+			SET consecutive_failures = 0, last_error = NULL
+			WHERE id = $1;
+		`, hook.id)
+	} else {
+		_, err = w.pool.Exec(ctx, `
+			UPDATE user_webhooks
+			SET consecutive_failures = consecutive_failures + 1,
+			    last_error           = $2,
+			    enabled              = consecutive_failures + 1 < $3,
+			    disabled_at          = CASE WHEN consecutive_failures + 1 >= $3
+			                                THEN CURRENT_TIMESTAMP ELSE disabled_at END
+			WHERE id = $1;
+		`, hook.id, deliveryErr.Error(), webhookMaxFailures)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error with updating webhook %d status: %w", hook.id, err)
+	}
+
+	return nil
+}
+
+// Notify Sends signed alert payload to each of the user's enabled webhooks it hasn't already been
+// delivered to.
+// Returns ErrNoTargets if the user has no enabled webhooks, or error if webhooks can't be queried
+// or any delivery fails
+func (w *WebhookNotifier) Notify(ctx context.Context, userID int, alert *SeatAlert) (string, error) {
+
+	webhooks, err := w.getUserWebhooks(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if len(webhooks) == 0 {
+		return "", ErrNoTargets
+	}
+
+	payload := webhookPayload{
+		Term:       alert.Term,
+		CourseID:   alert.CourseID,
+		CourseName: alert.CourseName,
+		SectionNum: alert.SectionNum,
+		AlertType:  alert.AlertType,
+		Expression: alert.Expression,
+		ClearedAlternatives: alert.ClearedAlternatives,
+		OpenSeats:  alert.OpenSeats,
+		SearchResults: alert.SearchResults,
+		Timestamp:  alert.Timestamp.UTC().Format(time.RFC3339),
+	}
+	payload.Waitlist.OpenSpots = alert.WaitlistOpenSpots
+	payload.Waitlist.Capacity = alert.WaitlistCapacity
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("Error with webhook payload marshal: %w", err)
+	}
+
+	var firstErr error
+	for _, hook := range webhooks {
+		target := targetKey(w.Channel(), hook.id)
+		if alert.sentTo(target) {
+			continue
+		}
+
+		deliveryErr := w.deliverWebhook(ctx, hook, alert.IdempotencyKey, body)
+		if deliveryErr != nil {
+			log.Printf("Webhook %d delivery failed for user %d: %v", hook.id, userID, deliveryErr)
+			if firstErr == nil {
+				firstErr = deliveryErr
+			}
+		} else if err := markTargetSent(ctx, w.pool, alert, target); err != nil {
+			log.Println(err)
+		}
+
+		if err := w.recordWebhookResult(ctx, hook, deliveryErr); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return "", firstErr
+}
+
+// checkWebhookURL Checks that a user supplied webhook URL is https and its host only resolves to
+// public addresses, so internal URLs are refused when saved rather than on every send.
+// Returns error if URL can't be used as a webhook
+func checkWebhookURL(ctx context.Context, hookURL string) error {
+
+	if err := requireHTTPS(hookURL); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(hookURL)
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(parsed.Hostname()); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname()); err != nil {
+		return fmt.Errorf("Error looking up webhook host %s: %w", parsed.Hostname(), err)
+	}
+
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return fmt.Errorf("Webhook host %s resolves to internal address %s", parsed.Hostname(), addr)
+		}
+	}
+
+	return nil
+}
+
+// SaveWebhook Checks URL and saves it as a webhook for the user with a new signing secret. Saving
+// a URL the user already has re-enables it and keeps its secret.
+// Returns ID and signing secret of webhook, or error if URL is invalid or webhook can't be saved
+func SaveWebhook(ctx context.Context, pool DB, userID int, hookURL string) (int64, string, error) {
+
+	if err := checkWebhookURL(ctx, hookURL); err != nil {
+		return 0, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return 0, "", fmt.Errorf("Error generating webhook secret: %w", err)
+	}
+
+	var hookID int64
+	var savedSecret string
+	if err := pool.QueryRow(ctx, `
+		INSERT INTO user_webhooks (user_id, url, secret)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, url)
+		DO UPDATE SET enabled = true, consecutive_failures = 0, last_error = NULL, disabled_at = NULL
+		RETURNING id, secret;
+	`, userID, hookURL, hex.EncodeToString(secret)).Scan(&hookID, &savedSecret); err != nil {
+		return 0, "", fmt.Errorf("Error saving webhook: %w", err)
+	}
+
+	return hookID, savedSecret, nil
+}
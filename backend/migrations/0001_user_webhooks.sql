@@ -0,0 +1,15 @@
+-- outbound webhooks that seat alerts are POSTed to
+CREATE TABLE IF NOT EXISTS user_webhooks (
+	id                   BIGSERIAL PRIMARY KEY,
+	user_id              INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	url                  TEXT        NOT NULL,
+	secret               TEXT        NOT NULL,
+	enabled              BOOLEAN     NOT NULL DEFAULT true,
+	consecutive_failures INTEGER     NOT NULL DEFAULT 0,
+	last_error           TEXT,
+	disabled_at          TIMESTAMPTZ,
+	created_at           TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, url)
+);
+
+CREATE INDEX IF NOT EXISTS user_webhooks_user_id_idx ON user_webhooks (user_id) WHERE enabled;
@@ -0,0 +1,23 @@
+-- Discord and Slack incoming webhooks that seat alerts can be posted to
+CREATE TABLE IF NOT EXISTS chat_webhooks (
+	id         BIGSERIAL PRIMARY KEY,
+	user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	platform   TEXT        NOT NULL CHECK (platform IN ('discord', 'slack')),
+	url        TEXT        NOT NULL,
+	label      TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, url)
+);
+
+-- alerts that a chat webhook is attached to, a single webhook (e.g. a study group channel)
+-- can be attached to any number of alerts
+CREATE TABLE IF NOT EXISTS alert_chat_webhooks (
+	chat_webhook_id BIGINT  NOT NULL REFERENCES chat_webhooks (id) ON DELETE CASCADE,
+	user_id         INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	course_id       TEXT    NOT NULL,
+	section_num     TEXT    NOT NULL,
+	PRIMARY KEY (chat_webhook_id, user_id, course_id, section_num)
+);
+
+CREATE INDEX IF NOT EXISTS alert_chat_webhooks_alert_idx
+	ON alert_chat_webhooks (user_id, course_id, section_num);
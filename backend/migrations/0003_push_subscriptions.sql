@@ -0,0 +1,13 @@
+-- browser Web Push subscriptions (PushSubscription.toJSON()) that seat alerts are pushed to
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	id              BIGSERIAL PRIMARY KEY,
+	user_id         INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	endpoint        TEXT        NOT NULL UNIQUE,
+	p256dh          TEXT        NOT NULL,
+	auth            TEXT        NOT NULL,
+	user_agent      TEXT,
+	created_at      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_success_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS push_subscriptions_user_id_idx ON push_subscriptions (user_id);
@@ -0,0 +1,28 @@
+-- alerts that have been set off, moved here from user_courses in the same statement that
+-- deletes them so an alert is never lost or sent twice if the notifier dies mid-run
+CREATE TABLE IF NOT EXISTS notification_outbox (
+	id                  BIGSERIAL PRIMARY KEY,
+	idempotency_key     TEXT        NOT NULL UNIQUE,
+	user_id             INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	email               TEXT        NOT NULL,
+	term                INTEGER     NOT NULL,
+	course_id           TEXT        NOT NULL,
+	course_name         TEXT        NOT NULL,
+	section_num         TEXT        NOT NULL,
+	alert_type          TEXT        NOT NULL,
+	seat_threshold      INTEGER,
+	open_seats          INTEGER     NOT NULL,
+	waitlist_open_spots INTEGER     NOT NULL DEFAULT 0,
+	waitlist_capacity   INTEGER     NOT NULL DEFAULT 0,
+	status              TEXT        NOT NULL DEFAULT 'pending'
+	                    CHECK (status IN ('pending', 'sending', 'sent', 'failed')),
+	channels_sent       TEXT[]      NOT NULL DEFAULT '{}',
+	attempts            INTEGER     NOT NULL DEFAULT 0,
+	last_error          TEXT,
+	next_attempt_at     TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created_at          TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at             TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS notification_outbox_due_idx
+	ON notification_outbox (next_attempt_at) WHERE status IN ('pending', 'sending');
@@ -0,0 +1,10 @@
+-- give alerts a stable id so the notifier can reference individual rows
+ALTER TABLE user_courses ADD COLUMN IF NOT EXISTS id BIGSERIAL;
+CREATE UNIQUE INDEX IF NOT EXISTS user_courses_id_idx ON user_courses (id);
+
+-- 'level' alerts fire whenever the section matches, 'edge' alerts only fire when the section goes
+-- from not matching to matching. last_matched is NULL until the notifier first sees the alert.
+ALTER TABLE user_courses
+	ADD COLUMN IF NOT EXISTS trigger_mode TEXT NOT NULL DEFAULT 'level'
+		CHECK (trigger_mode IN ('level', 'edge')),
+	ADD COLUMN IF NOT EXISTS last_matched BOOLEAN;
@@ -0,0 +1,14 @@
+-- persistent alerts are kept after they fire. Once fired an alert is disarmed until its section
+-- stops matching and its cooldown has passed, and it's removed once it has fired max_fires times
+-- (NULL for no limit) or expires_at has passed.
+ALTER TABLE user_courses
+	ADD COLUMN IF NOT EXISTS persistent       BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS cooldown_minutes INTEGER NOT NULL DEFAULT 60 CHECK (cooldown_minutes >= 0),
+	ADD COLUMN IF NOT EXISTS max_fires        INTEGER CHECK (max_fires > 0),
+	ADD COLUMN IF NOT EXISTS fire_count       INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS last_fired_at    TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS armed            BOOLEAN NOT NULL DEFAULT true,
+	ADD COLUMN IF NOT EXISTS expires_at       TIMESTAMPTZ;
+
+-- whether the alert was kept after firing, so emails don't say it was removed
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS alert_kept BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+-- 'waitlist' alerts fire when a full section has an open waitlist spot
+ALTER TABLE user_courses DROP CONSTRAINT IF EXISTS user_courses_alert_type_check;
+ALTER TABLE user_courses
+	ADD CONSTRAINT user_courses_alert_type_check
+	CHECK (alert_type IN ('any', 'threshold', 'waitlist'));
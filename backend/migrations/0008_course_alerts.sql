@@ -0,0 +1,20 @@
+-- course level alerts that aren't tied to a single section. 'new_section' alerts fire when a
+-- section (optionally only of section_type, e.g. 'LAB') is added to the course.
+CREATE TABLE IF NOT EXISTS course_alerts (
+	id           BIGSERIAL PRIMARY KEY,
+	user_id      INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	course_id    TEXT        NOT NULL,
+	term         INTEGER     NOT NULL,
+	alert_kind   TEXT        NOT NULL CHECK (alert_kind IN ('new_section')),
+	section_type TEXT,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE NULLS NOT DISTINCT (user_id, course_id, term, alert_kind, section_type)
+);
+
+CREATE INDEX IF NOT EXISTS course_alerts_course_idx ON course_alerts (course_id, term);
+
+-- details of the section an alert is for, shown in new section emails
+ALTER TABLE notification_outbox
+	ADD COLUMN IF NOT EXISTS section_type TEXT,
+	ADD COLUMN IF NOT EXISTS capacity     INTEGER,
+	ADD COLUMN IF NOT EXISTS prof_name    TEXT;
@@ -0,0 +1,17 @@
+-- sections that make up each enrollment package (e.g. LEC 001 + DIS 312 + LAB 305) of a course,
+-- kept in sync with the enrollment API by the scraper
+CREATE TABLE IF NOT EXISTS course_packages (
+	term         INTEGER     NOT NULL,
+	course_id    TEXT        NOT NULL,
+	package_key  TEXT        NOT NULL,
+	section_nums TEXT[]      NOT NULL,
+	last_updated TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (term, course_id, package_key)
+);
+
+-- 'any_package' course alerts fire when every section of any one enrollment package is open. With
+-- a section_type only the package's sections of that type need to be open.
+ALTER TABLE course_alerts DROP CONSTRAINT IF EXISTS course_alerts_alert_kind_check;
+ALTER TABLE course_alerts
+	ADD CONSTRAINT course_alerts_alert_kind_check
+	CHECK (alert_kind IN ('new_section', 'any_package'));
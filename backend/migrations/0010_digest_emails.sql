@@ -0,0 +1,5 @@
+-- 'instant' users get one email per alert, 'digest' users get one email per run listing every
+-- alert of theirs that went off
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS notification_mode TEXT NOT NULL DEFAULT 'instant'
+		CHECK (notification_mode IN ('instant', 'digest'));
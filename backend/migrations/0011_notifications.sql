@@ -0,0 +1,33 @@
+-- every attempt to deliver an alert through a channel, kept after the alert itself is gone so
+-- support can see what a user was sent and what went wrong
+CREATE TABLE IF NOT EXISTS notifications (
+	id                  BIGSERIAL PRIMARY KEY,
+	outbox_id           BIGINT      REFERENCES notification_outbox (id) ON DELETE SET NULL,
+	user_id             INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	recipient           TEXT,
+	channel             TEXT        NOT NULL,
+	term                INTEGER     NOT NULL,
+	course_id           TEXT        NOT NULL,
+	course_name         TEXT        NOT NULL,
+	section_num         TEXT        NOT NULL,
+	alert_type          TEXT        NOT NULL,
+	seat_threshold      INTEGER,
+
+	-- seat info when the alert matched and when it was sent
+	matched_open_seats  INTEGER     NOT NULL,
+	open_seats          INTEGER,
+	capacity            INTEGER,
+	waitlist_open_spots INTEGER,
+	waitlist_capacity   INTEGER,
+
+	provider_message_id TEXT,
+	status              TEXT        NOT NULL CHECK (status IN ('sent', 'failed')),
+	error               TEXT,
+	attempt             INTEGER     NOT NULL,
+	batched             BOOLEAN     NOT NULL DEFAULT false,
+	created_at          TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS notifications_message_idx ON notifications (provider_message_id)
+	WHERE provider_message_id IS NOT NULL;
@@ -0,0 +1,13 @@
+-- users whose address hard bounced or who marked an alert as spam, reported by SES through SNS.
+-- suppressed users aren't emailed until their status is set back to 'ok', their alerts are still
+-- matched and sent through their other channels (webhooks, chat and push)
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS email_status TEXT NOT NULL DEFAULT 'ok'
+		CHECK (email_status IN ('ok', 'bounced', 'complained')),
+	ADD COLUMN IF NOT EXISTS email_status_detail TEXT,
+	ADD COLUMN IF NOT EXISTS email_status_at     TIMESTAMPTZ;
+
+-- bounce or complaint SES reported for a sent notification
+ALTER TABLE notifications
+	ADD COLUMN IF NOT EXISTS feedback    TEXT CHECK (feedback IN ('bounce', 'complaint')),
+	ADD COLUMN IF NOT EXISTS feedback_at TIMESTAMPTZ;
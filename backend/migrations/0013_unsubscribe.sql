@@ -0,0 +1,10 @@
+-- users who used an unsubscribe link to stop all alert emails
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_status_check;
+ALTER TABLE users
+	ADD CONSTRAINT users_email_status_check
+		CHECK (email_status IN ('ok', 'bounced', 'complained', 'unsubscribed'));
+
+-- alert a queued entry came from, only set when the alert is kept so its email can link to
+-- cancelling it
+ALTER TABLE notification_outbox
+	ADD COLUMN IF NOT EXISTS alert_id BIGINT REFERENCES user_courses (id) ON DELETE SET NULL;
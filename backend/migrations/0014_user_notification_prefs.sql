@@ -0,0 +1,25 @@
+-- how and when each user wants to be contacted, users without a row get every channel at any time
+CREATE TABLE IF NOT EXISTS user_notification_prefs (
+	user_id           INTEGER     PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+
+	-- channels alerts are sent through (email, webhook, chat, push)
+	enabled_channels  TEXT[]      NOT NULL DEFAULT ARRAY['email', 'webhook', 'chat', 'push'],
+
+	-- IANA time zone quiet hours are in
+	time_zone         TEXT        NOT NULL DEFAULT 'America/Chicago',
+
+	-- local times quiet hours start and end (can wrap past midnight), no quiet hours if NULL
+	quiet_start       TIME,
+	quiet_end         TIME,
+
+	-- whether quiet hours also hold back seat alerts, or only informational ones (new sections)
+	quiet_seat_alerts BOOLEAN     NOT NULL DEFAULT true,
+
+	-- 'defer' holds alerts until quiet hours end, 'quiet_channels' sends them right away but only
+	-- through channels that don't interrupt (email, webhook)
+	quiet_mode        TEXT        NOT NULL DEFAULT 'defer' CHECK (quiet_mode IN ('defer', 'quiet_channels')),
+
+	updated_at        TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+	CHECK ((quiet_start IS NULL) = (quiet_end IS NULL))
+);
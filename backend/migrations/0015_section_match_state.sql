@@ -0,0 +1,14 @@
+-- how long each alert condition has matched a section for, so alerts on sections that flip between
+-- open and closed can wait for the section to settle. condition is the alert type, with the seat
+-- threshold added for threshold alerts. observations counts scrapes (distinct last_updated times)
+-- the condition has matched in a row, and rows are removed once the condition stops matching.
+CREATE TABLE IF NOT EXISTS section_match_state (
+	term          INTEGER     NOT NULL,
+	course_id     TEXT        NOT NULL,
+	section_num   TEXT        NOT NULL,
+	condition     TEXT        NOT NULL,
+	observations  INTEGER     NOT NULL DEFAULT 1,
+	matched_since TIMESTAMPTZ NOT NULL,
+	observed_at   TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (term, course_id, section_num, condition)
+);
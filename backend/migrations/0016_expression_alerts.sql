@@ -0,0 +1,16 @@
+-- 'expression' alerts fire when a CEL expression over the section's fields is true, e.g.
+-- open_seats >= 2 && section_type == "LAB". Expressions are validated before they're saved.
+ALTER TABLE user_courses ADD COLUMN IF NOT EXISTS expression TEXT;
+
+ALTER TABLE user_courses DROP CONSTRAINT IF EXISTS user_courses_alert_type_check;
+ALTER TABLE user_courses
+	ADD CONSTRAINT user_courses_alert_type_check
+	CHECK (alert_type IN ('any', 'threshold', 'waitlist', 'expression'));
+
+ALTER TABLE user_courses DROP CONSTRAINT IF EXISTS user_courses_expression_check;
+ALTER TABLE user_courses
+	ADD CONSTRAINT user_courses_expression_check
+	CHECK ((alert_type = 'expression') = (expression IS NOT NULL));
+
+-- expression that set off the alert, shown in the alert
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS expression TEXT;
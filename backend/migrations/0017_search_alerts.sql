@@ -0,0 +1,22 @@
+-- saved search alerts aren't tied to a course. They fire once any section matching the search has
+-- an open seat, and the user is sent every matching open section (up to a limit) in one digest.
+-- breadth_codes matches courses with any of the given breadths, and the catalog number range is
+-- inclusive. Unset filters match everything, but a search needs a breadth or a subject.
+CREATE TABLE IF NOT EXISTS search_alerts (
+	id            BIGSERIAL PRIMARY KEY,
+	user_id       INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	term          INTEGER     NOT NULL,
+	breadth_codes TEXT[]      NOT NULL DEFAULT '{}',
+	subject_id    INTEGER,
+	catalog_min   INTEGER     CHECK (catalog_min >= 0),
+	catalog_max   INTEGER     CHECK (catalog_max >= 0),
+	section_type  TEXT,
+	created_at    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CHECK (catalog_min IS NULL OR catalog_max IS NULL OR catalog_min <= catalog_max),
+	CHECK (cardinality(breadth_codes) > 0 OR subject_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS search_alerts_term_idx ON search_alerts (term);
+
+-- search the entry was matched by, entries from the same search are sent together
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS search_id BIGINT;
@@ -0,0 +1,24 @@
+-- groups of a user's alerts where only the first to fire matters (e.g. whichever of three sections
+-- opens first). When a member fires the group's other alerts are cancelled ('cancel'), or paused
+-- for pause_minutes ('pause').
+CREATE TABLE IF NOT EXISTS alert_groups (
+	id            BIGSERIAL PRIMARY KEY,
+	user_id       INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	on_fire       TEXT        NOT NULL DEFAULT 'cancel' CHECK (on_fire IN ('cancel', 'pause')),
+	pause_minutes INTEGER     CHECK (pause_minutes > 0),
+	created_at    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CHECK (on_fire = 'cancel' OR pause_minutes IS NOT NULL)
+);
+
+-- paused alerts don't fire until paused_until has passed
+ALTER TABLE user_courses
+	ADD COLUMN IF NOT EXISTS group_id     BIGINT REFERENCES alert_groups (id) ON DELETE SET NULL,
+	ADD COLUMN IF NOT EXISTS paused_until TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS user_courses_group_idx ON user_courses (group_id) WHERE group_id IS NOT NULL;
+
+-- group alternatives cleared when the alert fired, shown in the alert. alternatives_paused_minutes
+-- is NULL if they were cancelled.
+ALTER TABLE notification_outbox
+	ADD COLUMN IF NOT EXISTS cleared_alternatives        TEXT[],
+	ADD COLUMN IF NOT EXISTS alternatives_paused_minutes INTEGER;
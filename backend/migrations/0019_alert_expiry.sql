@@ -0,0 +1,45 @@
+-- enrollment dates for each term, alerts expire at the end of their term's last add date by default
+CREATE TABLE IF NOT EXISTS terms (
+	term          INTEGER PRIMARY KEY,
+	last_add_date DATE    NOT NULL
+);
+
+-- expires_at (added for persistent alerts) now applies to every alert. Alerts saved without one
+-- expire at the end of their term's last add date, Madison time.
+CREATE OR REPLACE FUNCTION set_alert_expiry() RETURNS trigger AS $$
+BEGIN
+	IF NEW.expires_at IS NULL THEN
+		SELECT (t.last_add_date + 1)::timestamp AT TIME ZONE 'America/Chicago'
+		INTO NEW.expires_at
+		FROM course_sections cs
+		JOIN terms t ON t.term = cs.term
+		WHERE cs.course_id   = NEW.course_id
+		  AND cs.section_num = NEW.section_num
+		LIMIT 1;
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_courses_expiry ON user_courses;
+CREATE TRIGGER user_courses_expiry
+	BEFORE INSERT ON user_courses
+	FOR EACH ROW EXECUTE FUNCTION set_alert_expiry();
+
+-- alerts removed by the cleanup job, so they no longer count against the alert limit
+CREATE TABLE IF NOT EXISTS user_courses_archive (
+	id             BIGINT      PRIMARY KEY,
+	user_id        INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	course_id      TEXT        NOT NULL,
+	section_num    TEXT        NOT NULL,
+	alert_type     TEXT        NOT NULL,
+	seat_threshold INTEGER,
+	expression     TEXT,
+	persistent     BOOLEAN     NOT NULL,
+	fire_count     INTEGER     NOT NULL,
+	expires_at     TIMESTAMPTZ,
+	reason         TEXT        NOT NULL,
+	archived_at    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_courses_archive_user_idx ON user_courses_archive (user_id);
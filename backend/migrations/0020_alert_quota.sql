@@ -0,0 +1,70 @@
+-- alert quotas per user tier, users can have at most max_alerts alerts at once
+CREATE TABLE IF NOT EXISTS alert_tiers (
+	tier       TEXT    PRIMARY KEY,
+	max_alerts INTEGER NOT NULL CHECK (max_alerts >= 0)
+);
+
+INSERT INTO alert_tiers (tier, max_alerts)
+VALUES ('free', 20), ('plus', 50)
+ON CONFLICT (tier) DO NOTHING;
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS tier TEXT NOT NULL DEFAULT 'free' REFERENCES alert_tiers (tier);
+
+-- thresholds only belong to threshold alerts and must be at least 1 seat
+UPDATE user_courses SET seat_threshold = NULL WHERE alert_type <> 'threshold';
+
+ALTER TABLE user_courses DROP CONSTRAINT IF EXISTS user_courses_threshold_check;
+ALTER TABLE user_courses
+	ADD CONSTRAINT user_courses_threshold_check
+	CHECK ((alert_type = 'threshold') = (seat_threshold IS NOT NULL) AND (seat_threshold >= 1));
+
+-- remove duplicate alerts (keeping the oldest) so they can be prevented
+DELETE FROM user_courses uc
+USING user_courses older
+WHERE older.user_id     = uc.user_id
+  AND older.course_id   = uc.course_id
+  AND older.section_num = uc.section_num
+  AND older.alert_type  = uc.alert_type
+  AND older.seat_threshold IS NOT DISTINCT FROM uc.seat_threshold
+  AND older.expression     IS NOT DISTINCT FROM uc.expression
+  AND older.id < uc.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_courses_unique_idx
+	ON user_courses (user_id, course_id, section_num, alert_type, COALESCE(seat_threshold, 0),
+	                 COALESCE(expression, ''));
+
+-- alerts must be for a scraped section, existing alerts for unknown sections are left to expire
+ALTER TABLE user_courses DROP CONSTRAINT IF EXISTS user_courses_section_fkey;
+ALTER TABLE user_courses
+	ADD CONSTRAINT user_courses_section_fkey
+	FOREIGN KEY (course_id, section_num) REFERENCES course_sections (course_id, section_num)
+	NOT VALID;
+
+-- enforce the user's quota on every insert. The user's row is locked so concurrent inserts
+-- can't both squeeze under the limit.
+CREATE OR REPLACE FUNCTION check_alert_quota() RETURNS trigger AS $$
+DECLARE
+	quota    INTEGER;
+	existing INTEGER;
+BEGIN
+	SELECT t.max_alerts INTO quota
+	FROM users u
+	JOIN alert_tiers t ON t.tier = u.tier
+	WHERE u.id = NEW.user_id
+	FOR UPDATE OF u;
+
+	SELECT count(*) INTO existing FROM user_courses WHERE user_id = NEW.user_id;
+
+	IF existing >= quota THEN
+		RAISE EXCEPTION 'User % already has % of % alerts', NEW.user_id, existing, quota
+			USING ERRCODE = 'check_violation', CONSTRAINT = 'user_courses_quota';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_courses_quota ON user_courses;
+CREATE TRIGGER user_courses_quota
+	BEFORE INSERT ON user_courses
+	FOR EACH ROW EXECUTE FUNCTION check_alert_quota();
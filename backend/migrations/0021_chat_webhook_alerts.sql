@@ -0,0 +1,26 @@
+-- attach chat webhooks to alerts by ID so attachments are removed along with their alert
+CREATE TABLE IF NOT EXISTS alert_chat_webhooks_by_id (
+	chat_webhook_id BIGINT NOT NULL REFERENCES chat_webhooks (id) ON DELETE CASCADE,
+	alert_id        BIGINT NOT NULL REFERENCES user_courses (id) ON DELETE CASCADE,
+	PRIMARY KEY (chat_webhook_id, alert_id)
+);
+
+-- attachments whose alert no longer exists are dropped
+INSERT INTO alert_chat_webhooks_by_id (chat_webhook_id, alert_id)
+SELECT acw.chat_webhook_id, uc.id
+FROM alert_chat_webhooks acw
+JOIN user_courses uc
+     ON uc.user_id     = acw.user_id
+    AND uc.course_id   = acw.course_id
+    AND uc.section_num = acw.section_num
+ON CONFLICT DO NOTHING;
+
+DROP TABLE alert_chat_webhooks;
+ALTER TABLE alert_chat_webhooks_by_id RENAME TO alert_chat_webhooks;
+ALTER INDEX alert_chat_webhooks_by_id_pkey RENAME TO alert_chat_webhooks_pkey;
+
+CREATE INDEX IF NOT EXISTS alert_chat_webhooks_alert_idx ON alert_chat_webhooks (alert_id);
+
+-- chat webhooks attached to the alert when it was queued, one time alerts are deleted (along
+-- with their attachments) before they're sent
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS chat_webhook_ids BIGINT[];
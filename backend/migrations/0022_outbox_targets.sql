@@ -0,0 +1,4 @@
+-- individual targets (e.g. one of a user's webhooks, as 'webhook:<id>') an entry has been
+-- delivered to, so a retry after one target fails doesn't resend to the others
+ALTER TABLE notification_outbox
+	ADD COLUMN IF NOT EXISTS targets_sent TEXT[] NOT NULL DEFAULT '{}';
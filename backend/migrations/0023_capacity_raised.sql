@@ -0,0 +1,3 @@
+-- capacity a section had before it was raised, set for new section alerts sent because an
+-- existing section's capacity went up rather than because it was added
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS old_capacity INTEGER;
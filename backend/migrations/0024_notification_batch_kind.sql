@@ -0,0 +1,16 @@
+-- whether a batched delivery was part of a user's digest or an SES bulk send of separate emails
+ALTER TABLE notifications
+	ADD COLUMN IF NOT EXISTS batch_kind TEXT CHECK (batch_kind IN ('digest', 'bulk'));
+
+-- digests share one message between several alerts, bulk sends give each alert its own. Failed
+-- batched deliveries have no message ID and are left unknown.
+UPDATE notifications n
+SET batch_kind = CASE
+	WHEN (SELECT count(DISTINCT other.outbox_id)
+	      FROM notifications other
+	      WHERE other.provider_message_id = n.provider_message_id) > 1 THEN 'digest'
+	ELSE 'bulk'
+END
+WHERE n.batched
+  AND n.batch_kind IS NULL
+  AND n.provider_message_id IS NOT NULL;
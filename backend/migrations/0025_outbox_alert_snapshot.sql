@@ -0,0 +1,3 @@
+-- one time alerts as they were before they fired and were removed, so an alert whose section no
+-- longer matches when it's re-checked before sending can be put back
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS alert_snapshot JSONB;
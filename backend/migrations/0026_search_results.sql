@@ -0,0 +1,10 @@
+-- a saved search is queued as one outbox entry carrying every matching open section (best first),
+-- the entry's own section columns hold the best match
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS search_results JSONB;
+
+-- how long a saved search has had open matches for, so searches are debounced like alerts on a
+-- single section. observations counts scrapes (latest last_updated of the matching sections) the
+-- search has matched in a row, and is reset once the search stops matching.
+ALTER TABLE search_alerts ADD COLUMN IF NOT EXISTS match_observations INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE search_alerts ADD COLUMN IF NOT EXISTS matched_since TIMESTAMPTZ;
+ALTER TABLE search_alerts ADD COLUMN IF NOT EXISTS observed_at TIMESTAMPTZ;
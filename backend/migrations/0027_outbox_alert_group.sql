@@ -0,0 +1,3 @@
+-- group of the alert that fired. The group's other alerts are held (paused) until the entry is
+-- sent and only then cancelled or paused, or released if the entry fails or is dropped.
+ALTER TABLE notification_outbox ADD COLUMN IF NOT EXISTS group_id BIGINT;
@@ -0,0 +1,18 @@
+-- alerts saved without an expiry expire at the end of the current term's last add date (the
+-- newest term in terms). A section last scraped in an older term no longer gives its alerts that
+-- term's date.
+CREATE OR REPLACE FUNCTION set_alert_expiry() RETURNS trigger AS $$
+BEGIN
+	IF NEW.expires_at IS NULL THEN
+		SELECT (t.last_add_date + 1)::timestamp AT TIME ZONE 'America/Chicago'
+		INTO NEW.expires_at
+		FROM (SELECT max(term) AS term FROM terms) cur
+		LEFT JOIN course_sections cs
+		     ON cs.course_id   = NEW.course_id
+		    AND cs.section_num = NEW.section_num
+		    AND cs.term        = cur.term
+		JOIN terms t ON t.term = COALESCE(cs.term, cur.term);
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,45 @@
+-- course_sections is keyed by course and section only, so user_courses_section_fkey accepts
+-- sections last scraped in an old term. New alerts must also be for a section in the current term
+-- (the newest term in terms, any term if none are set).
+CREATE OR REPLACE FUNCTION check_alert_section_term() RETURNS trigger AS $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1
+		FROM course_sections cs
+		WHERE cs.course_id   = NEW.course_id
+		  AND cs.section_num = NEW.section_num
+		  AND cs.term        = COALESCE((SELECT max(term) FROM terms), cs.term)
+	) THEN
+		RAISE EXCEPTION 'section % of course % isn''t offered this term', NEW.section_num, NEW.course_id
+			USING ERRCODE = 'foreign_key_violation', CONSTRAINT = 'user_courses_section_term';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_courses_section_term ON user_courses;
+CREATE TRIGGER user_courses_section_term
+	BEFORE INSERT OR UPDATE OF course_id, section_num ON user_courses
+	FOR EACH ROW EXECUTE FUNCTION check_alert_section_term();
+
+-- same quota message as the alert service so it can be shown to users
+CREATE OR REPLACE FUNCTION check_alert_quota() RETURNS trigger AS $$
+DECLARE
+	quota    INTEGER;
+	existing INTEGER;
+BEGIN
+	SELECT t.max_alerts INTO quota
+	FROM users u
+	JOIN alert_tiers t ON t.tier = u.tier
+	WHERE u.id = NEW.user_id
+	FOR UPDATE OF u;
+
+	SELECT count(*) INTO existing FROM user_courses WHERE user_id = NEW.user_id;
+
+	IF existing >= quota THEN
+		RAISE EXCEPTION 'you can only save up to % alerts (you have %)', quota, existing
+			USING ERRCODE = 'check_violation', CONSTRAINT = 'user_courses_quota';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
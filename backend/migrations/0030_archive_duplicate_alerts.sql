@@ -0,0 +1,23 @@
+-- 0020 removed duplicate alerts without keeping them. Duplicates are now removed by archiving them
+-- (keeping the oldest), so anything left over, e.g. on a database where 0020's unique index already
+-- existed, can be looked up in user_courses_archive.
+WITH duplicates AS (
+	DELETE FROM user_courses uc
+	USING user_courses older
+	WHERE older.user_id     = uc.user_id
+	  AND older.course_id   = uc.course_id
+	  AND older.section_num = uc.section_num
+	  AND older.alert_type  = uc.alert_type
+	  AND older.seat_threshold IS NOT DISTINCT FROM uc.seat_threshold
+	  AND older.expression     IS NOT DISTINCT FROM uc.expression
+	  AND older.id < uc.id
+	RETURNING uc.*
+)
+INSERT INTO user_courses_archive (
+	id, user_id, course_id, section_num, alert_type, seat_threshold, expression,
+	persistent, fire_count, expires_at, reason
+)
+SELECT id, user_id, course_id, section_num, alert_type, seat_threshold, expression,
+       persistent, fire_count, expires_at, 'duplicate'
+FROM duplicates
+ON CONFLICT (id) DO NOTHING;
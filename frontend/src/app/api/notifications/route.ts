@@ -1,21 +1,20 @@
 import { NextResponse } from 'next/server'
 import { getAdminAuth } from '@/lib/firebase-admin'
 import { query } from '@/lib/db'
-import { IdRow, CountRow, ExistsRow } from '@/lib/types'
+import { IdRow } from '@/lib/types'
 
 export async function POST(req: Request) {
   try {
 
     const adminAuth = getAdminAuth()
-    const { token, courseId, sectionNum, alertType, seatThreshold } = await req.json()
+    const { token, courseId, sectionNum, alertType, seatThreshold, expression } = await req.json()
     const decoded = await adminAuth.verifyIdToken(token, true)
     const firebaseUid = decoded.uid
     const email = decoded.email ?? null
 
-    // validate inputs
+    // validate inputs, the alert service validates each alert including expressions
     if (
-      !['any', 'threshold'].includes(alertType) ||
-      (alertType === 'threshold' && (!seatThreshold || seatThreshold < 1)) ||
+      !['any', 'threshold', 'waitlist', 'expression'].includes(alertType) ||
       !Array.isArray(sectionNum) ||
       sectionNum.length === 0
     ) {
@@ -35,57 +34,39 @@ export async function POST(req: Request) {
     )
     const userId = userResult.rows[0].id
 
-    // get number of already existing alerts for the user
-    const countResult = await query<CountRow>(
-      `SELECT COUNT(*)::int AS count
-       FROM user_courses
-       WHERE user_id = $1`,
-      [userId],
-    )
-    const existingAlerts = countResult.rows[0].count
-
-    // check if adding selected alerts will put user over limit and return error if so
-    if (existingAlerts + sectionNum.length > 20) {
-      return NextResponse.json(
-        { error: `You can only save up to 20 alerts (you have ${existingAlerts}).`},
-        { status: 410}
-      );
+    // save every selected section's alert at once through the alert service, which checks the
+    // user's tier quota, duplicate alerts, that each section exists and that expressions compile
+    const alerts = sectionNum.map((num: string) => ({
+      courseId,
+      sectionNum: num,
+      alertType,
+      seatThreshold: alertType === 'threshold' ? seatThreshold : null,
+      expression: alertType === 'expression' ? expression : '',
+    }))
+    const res = await fetch(process.env.ALERTS_API_URL!, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        Authorization: `Bearer ${process.env.ALERTS_API_SECRET}`,
+      },
+      body: JSON.stringify({ userId, alerts }),
+    })
+
+    // invalid alerts, missing sections and the quota are explained by the alert service, e.g.
+    // "You can only save up to 20 alerts (you have 20)"
+    if ([400, 404, 410].includes(res.status)) {
+      const { error } = await res.json()
+      return NextResponse.json({ error }, { status: res.status })
     }
-
-    // check each selected section and return an error if any already exist
-    // and return error if so
-    for (const sec of sectionNum) {
-      const existsResult = await query<ExistsRow>(
-        `
-        SELECT EXISTS(
-          SELECT 1
-          FROM user_courses
-          WHERE user_id       = $1
-            AND course_id     = $2
-            AND section_num   = $3
-            AND alert_type    = $4
-            AND (seat_threshold IS NOT DISTINCT FROM $5)
-        ) AS exists
-        `,
-        [userId, courseId, sec, alertType, seatThreshold ?? null]
-      )
-      if (existsResult.rows[0].exists) {
-        return NextResponse.json(
-          { error: 'You’ve already saved that exact alert.' },
-          { status: 409 }
-        )
-      }
-
-      // insert course alert into DB
-      await query(
-        `
-        INSERT INTO user_courses
-               (user_id, course_id, section_num, alert_type, seat_threshold)
-        VALUES ($1, $2, $3, $4, $5)
-        `,
-        [userId, courseId, sec, alertType, seatThreshold ?? null]
+    if (res.status === 409) {
+      return NextResponse.json(
+        { error: 'You’ve already saved that exact alert.' },
+        { status: 409 }
       )
     }
+    if (!res.ok) {
+      throw new Error(`Alert service responded ${res.status}`)
+    }
 
     return NextResponse.json({ ok: true })
 
@@ -41,10 +41,11 @@ export default function NotifyPopup({
   const hasClosed   = closedSubs.length  > 0
   const hasOpen     = alreadyOpen.length > 0
 
-  const [mode,        setMode]      = useState<'any' | 'threshold'>('any')
-  const [threshold,   setThreshold] = useState('1')
-  const [multiSubs,   setMultiSubs] = useState<string[]>([])
-  const [singleSub,   setSingleSub] = useState('')
+  const [mode,        setMode]       = useState<'any' | 'threshold' | 'expression'>('any')
+  const [threshold,   setThreshold]  = useState('1')
+  const [expression,  setExpression] = useState('')
+  const [multiSubs,   setMultiSubs]  = useState<string[]>([])
+  const [singleSub,   setSingleSub]  = useState('')
 
   const allChecked = multiSubs.length === closedSubs.length && hasClosed
   const chosenOpenSeats =
@@ -54,6 +55,7 @@ export default function NotifyPopup({
     if (open) {
       setMode(hasClosed ? 'any' : 'threshold')
       setThreshold('1')
+      setExpression('')
       setMultiSubs([])
       setSingleSub('')
     }
@@ -94,11 +96,16 @@ export default function NotifyPopup({
         toast.error('Threshold exceeds current open seats.'); return
       }
     }
+    if (mode === 'expression' && !expression.trim()) {
+      toast.error('Enter an expression.')
+      return
+    }
 
     try {
       const token = await auth.currentUser.getIdToken()
 
-      // create request body that contains section alert info
+      // create request body that contains section alert info, expression alerts are saved on
+      // every subsection since the expression can pick sections itself
       const body  = {
         token,
         courseId,
@@ -107,9 +114,12 @@ export default function NotifyPopup({
             ? [sectionNum]
             : mode === 'any'
             ? multiSubs
+            : mode === 'expression'
+            ? subsections.map(s => s.section_num)
             : [singleSub],
         alertType:     mode,
         seatThreshold: mode === 'threshold' ? +threshold : null,
+        expression:    mode === 'expression' ? expression.trim() : '',
       }
 
       // get resonse body from notifications API call
@@ -125,9 +135,7 @@ export default function NotifyPopup({
       if (response.ok) {
         toast.success('Alert saved!')
         onOpenChange(false)
-      } else if (response.status === 409) {
-        toast.error(data.error)
-      } else if (response.status === 410) {
+      } else if ([400, 404, 409, 410].includes(response.status)) {
         toast.error(data.error)
       } else {
         throw new Error()
@@ -146,7 +154,7 @@ export default function NotifyPopup({
 
         <RadioGroup
           value={mode}
-          onValueChange={v => setMode(v as 'any' | 'threshold')}
+          onValueChange={v => setMode(v as 'any' | 'threshold' | 'expression')}
           className="space-y-4"
         >
           {subsections.length === 0 ? (
@@ -282,6 +290,21 @@ export default function NotifyPopup({
               )}
             </>
           )}
+
+          <label className="flex flex-col items-center gap-2 text-center">
+            <Line>
+              <RadioGroupItem id="expression" value="expression" />
+              When this is true for {subsections.length === 0 ? sectionNum : 'a section'}:
+            </Line>
+            <Input
+              value={expression}
+              onChange={e => setExpression(e.target.value)}
+              placeholder='open_seats >= 2 && section_type == "LAB"'
+              maxLength={500}
+              className="w-full sm:w-80 font-mono text-sm"
+              disabled={mode !== 'expression'}
+            />
+          </label>
         </RadioGroup>
 
         <Button